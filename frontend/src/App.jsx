@@ -1,5 +1,5 @@
 import { useState, useRef } from 'react'
-import { Zap, Download, CheckCircle2 } from 'lucide-react'
+import { Zap, Download, CheckCircle2, Headphones } from 'lucide-react'
 import { useWebHaptics } from 'web-haptics/react'
 import useConverter from './hooks/useConverter'
 import Dropzone from './components/Dropzone'
@@ -14,8 +14,8 @@ export default function App() {
   
   const {
     apiInfo, file, loading, percent, status, error,
-    downloadUrl, downloadName, accept, canReset,
-    pickFile, submit, reset, cancel,
+    downloadUrl, downloadName, accept, canReset, previewUrl, previewing,
+    pickFile, submit, reset, cancel, preview,
   } = useConverter()
 
   const [intensity, setIntensity] = useState(1.0)
@@ -76,6 +76,22 @@ export default function App() {
                 onChange={setIntensity} 
                 disabled={loading} 
               />
+
+              <button
+                type="button"
+                className="btn-ghost btn-preview"
+                disabled={!file || loading || previewing}
+                onClick={() => {
+                  haptic.trigger('soft')
+                  preview(intensity)
+                }}
+              >
+                <Headphones size={16} />
+                <span>{previewing ? 'Rendering preview\u2026' : 'Preview 20s'}</span>
+              </button>
+              {previewUrl && (
+                <audio className="preview-audio" src={previewUrl} controls autoPlay />
+              )}
               
               <div className="engine-actions">
                 {loading ? (
@@ -1,7 +1,7 @@
 import { useState, useCallback, useEffect, useRef } from 'react'
 import { useWebHaptics } from 'web-haptics/react'
 
-const FALLBACK_ACCEPT = '.mp3,.m4a,.wav,.flac,.aac,.ogg'
+const FALLBACK_ACCEPT = '.mp3,.m4a,.wav,.flac,.aac,.ogg,.mkv,.mov,.mp4,.webm'
 const FALLBACK_SUFFIX = '_modified.mp3'
 
 export default function useConverter() {
@@ -14,8 +14,11 @@ export default function useConverter() {
   const [error, setError] = useState(false)
   const [downloadUrl, setDownloadUrl] = useState(null)
   const [downloadName, setDownloadName] = useState(null)
+  const [previewUrl, setPreviewUrl] = useState(null)
+  const [previewing, setPreviewing] = useState(false)
   const esRef = useRef(null)
   const jobIdRef = useRef(null)
+  const previewAbortRef = useRef(null)
 
   useEffect(() => {
     fetch('/api/info')
@@ -24,16 +27,6 @@ export default function useConverter() {
       .catch(() => {})
   }, [])
 
-  useEffect(() => {
-    const onUnload = () => {
-      if (jobIdRef.current) {
-        navigator.sendBeacon(`/convert/cancel/${jobIdRef.current}`)
-      }
-    }
-    window.addEventListener('beforeunload', onUnload)
-    return () => window.removeEventListener('beforeunload', onUnload)
-  }, [])
-
   const closeES = useCallback(() => {
     if (esRef.current) {
       esRef.current.close()
@@ -52,6 +45,16 @@ export default function useConverter() {
     setDownloadName(null)
   }, [])
 
+  const clearPreview = useCallback(() => {
+    previewAbortRef.current?.abort()
+    previewAbortRef.current = null
+    setPreviewing(false)
+    setPreviewUrl((u) => {
+      if (u) URL.revokeObjectURL(u)
+      return null
+    })
+  }, [])
+
   const stopJob = useCallback(() => {
     if (jobIdRef.current) {
       fetch(`/convert/cancel/${jobIdRef.current}`, { method: 'POST' }).catch(() => {})
@@ -72,7 +75,8 @@ export default function useConverter() {
     if (!f) return
     setFile(f)
     clearState()
-  }, [clearState])
+    clearPreview()
+  }, [clearState, clearPreview])
 
   const cancel = useCallback(() => {
     stopJob()
@@ -85,7 +89,46 @@ export default function useConverter() {
     setFile(null)
     setLoading(false)
     clearState()
-  }, [stopJob, clearState])
+    clearPreview()
+  }, [stopJob, clearState, clearPreview])
+
+  // preview renders the first seconds at the given intensity so the slider
+  // can be auditioned before committing to a full conversion.
+  const preview = useCallback(async (intensity = 1.0) => {
+    if (!file) return
+
+    clearPreview()
+    const ctrl = new AbortController()
+    previewAbortRef.current = ctrl
+    setPreviewing(true)
+    setStatus(null)
+    setError(false)
+
+    const form = new FormData()
+    form.append('file', file)
+    form.append('intensity', intensity.toString())
+    form.append('preview', 'true')
+
+    try {
+      const res = await fetch('/convert', { method: 'POST', body: form, signal: ctrl.signal })
+      if (!res.ok) {
+        const data = await res.json().catch(() => ({}))
+        throw new Error(data.error || res.statusText || 'Preview failed')
+      }
+      const blob = await res.blob()
+      setPreviewUrl(URL.createObjectURL(blob))
+    } catch (err) {
+      if (err.name !== 'AbortError') {
+        setStatus(err.message || 'Preview failed. Try again.')
+        setError(true)
+      }
+    } finally {
+      if (previewAbortRef.current === ctrl) {
+        previewAbortRef.current = null
+        setPreviewing(false)
+      }
+    }
+  }, [file, clearPreview])
 
   const submit = useCallback(async (intensity = 1.0) => {
     if (!file) return
@@ -104,41 +147,50 @@ export default function useConverter() {
         const data = await res.json().catch(() => ({}))
         throw new Error(data.error || res.statusText || 'Conversion failed')
       }
-      const { job_id } = await res.json()
+      const { job_id, download_url } = await res.json()
       jobIdRef.current = job_id
 
       const es = new EventSource(`/convert/progress/${job_id}`)
       esRef.current = es
 
-      es.onmessage = async (event) => {
+      const onProgress = (event) => {
         const msg = JSON.parse(event.data)
         setPercent(msg.percent || 0)
+      }
+      es.addEventListener('queued', onProgress)
+      es.addEventListener('progress', onProgress)
 
-        if (msg.error) return fail(msg.error)
-
-        if (msg.done) {
-          closeES()
-          setPercent(100)
-          try {
-            const dl = await fetch(`/convert/download/${job_id}`)
-            if (!dl.ok) throw new Error('Download failed')
-            const blob = await dl.blob()
-            const disp = dl.headers.get('Content-Disposition')
-            const match = disp?.match(/filename="?([^";]+)"?/)
-            setDownloadUrl(URL.createObjectURL(blob))
-            setDownloadName(match?.[1]?.trim() || `audio${apiInfo?.download_suffix || FALLBACK_SUFFIX}`)
-            setStatus('Ready. Same sound, different fingerprint.')
-            setLoading(false)
-            jobIdRef.current = null
-            haptic.trigger('success')
-            setTimeout(() => haptic.trigger('heavy'), 120)
-          } catch {
-            fail('Download didn\u2019t complete. Try again.')
-          }
+      es.addEventListener('failed', (event) => {
+        const msg = JSON.parse(event.data)
+        fail(msg.error || 'Conversion failed')
+      })
+
+      es.addEventListener('done', async () => {
+        closeES()
+        setPercent(100)
+        try {
+          const dl = await fetch(download_url)
+          if (!dl.ok) throw new Error('Download failed')
+          const blob = await dl.blob()
+          const disp = dl.headers.get('Content-Disposition')
+          const match = disp?.match(/filename="?([^";]+)"?/)
+          setDownloadUrl(URL.createObjectURL(blob))
+          setDownloadName(match?.[1]?.trim() || `audio${apiInfo?.download_suffix || FALLBACK_SUFFIX}`)
+          setStatus('Ready. Same sound, different fingerprint.')
+          setLoading(false)
+          jobIdRef.current = null
+          haptic.trigger('success')
+          setTimeout(() => haptic.trigger('heavy'), 120)
+        } catch {
+          fail('Download didn\u2019t complete. Try again.')
         }
-      }
+      })
 
-      es.onerror = () => fail('Connection lost. Please try again.')
+      // EventSource reconnects on its own and resumes via Last-Event-ID;
+      // only give up once the browser has stopped retrying.
+      es.onerror = () => {
+        if (es.readyState === EventSource.CLOSED) fail('Connection lost. Please try again.')
+      }
     } catch (err) {
       fail(err.message || 'Something went wrong. Try again.')
     }
@@ -148,8 +200,8 @@ export default function useConverter() {
 
   return {
     apiInfo, file, loading, percent, status, error,
-    downloadUrl, downloadName, accept,
-    pickFile, submit, reset, cancel,
+    downloadUrl, downloadName, accept, previewUrl, previewing,
+    pickFile, submit, reset, cancel, preview,
     canReset: !!(file || status || downloadUrl),
   }
 }
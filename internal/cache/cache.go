@@ -0,0 +1,199 @@
+// Package cache stores conversion outputs on disk keyed by content, evicting
+// the least recently used entries once the directory grows past its limit.
+package cache
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+var reKey = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+type entry struct {
+	size     int64
+	lastUsed time.Time
+}
+
+type Cache struct {
+	dir      string
+	maxBytes int64
+
+	mu        sync.Mutex
+	entries   map[string]*entry
+	bytes     int64
+	hits      int64
+	misses    int64
+	evictions int64
+	evicted   int64
+}
+
+type Stats struct {
+	Entries      int   `json:"entries"`
+	Bytes        int64 `json:"bytes"`
+	MaxBytes     int64 `json:"max_bytes"`
+	Hits         int64 `json:"hits"`
+	Misses       int64 `json:"misses"`
+	Evictions    int64 `json:"evictions"`
+	EvictedBytes int64 `json:"evicted_bytes"`
+}
+
+// Open uses dir as the cache directory, picking up entries left by earlier
+// runs with their modification times as last use.
+func Open(dir string, maxBytes int64) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	c := &Cache{dir: dir, maxBytes: maxBytes, entries: make(map[string]*entry)}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if !reKey.MatchString(f.Name()) {
+			continue
+		}
+		if fi, err := f.Info(); err == nil && fi.Mode().IsRegular() {
+			c.entries[f.Name()] = &entry{size: fi.Size(), lastUsed: fi.ModTime()}
+			c.bytes += fi.Size()
+		}
+	}
+	c.mu.Lock()
+	c.evict()
+	c.mu.Unlock()
+	return c, nil
+}
+
+// Get places the cached output for key at dst and reports whether it was
+// there.
+func (c *Cache) Get(key, dst string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.entries[key]
+	if e == nil {
+		c.misses++
+		return false
+	}
+	if err := linkOrCopy(c.path(key), dst); err != nil {
+		log.Printf("cache: %v", err)
+		c.drop(key)
+		c.misses++
+		return false
+	}
+	now := time.Now()
+	e.lastUsed = now
+	_ = os.Chtimes(c.path(key), now, now)
+	c.hits++
+	return true
+}
+
+// Put stores a copy of src under key.
+func (c *Cache) Put(key, src string) error {
+	if !reKey.MatchString(key) {
+		return fmt.Errorf("cache: invalid key %q", key)
+	}
+	fi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if fi.Size() > c.maxBytes {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; ok {
+		return nil
+	}
+	if err := linkOrCopy(src, c.path(key)); err != nil {
+		return err
+	}
+	c.entries[key] = &entry{size: fi.Size(), lastUsed: time.Now()}
+	c.bytes += fi.Size()
+	c.evict()
+	return nil
+}
+
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return Stats{
+		Entries:      len(c.entries),
+		Bytes:        c.bytes,
+		MaxBytes:     c.maxBytes,
+		Hits:         c.hits,
+		Misses:       c.misses,
+		Evictions:    c.evictions,
+		EvictedBytes: c.evicted,
+	}
+}
+
+// evict removes least recently used entries until the cache fits. Callers
+// must hold c.mu.
+func (c *Cache) evict() {
+	if c.bytes <= c.maxBytes {
+		return
+	}
+	keys := make([]string, 0, len(c.entries))
+	for k := range c.entries {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return c.entries[keys[i]].lastUsed.Before(c.entries[keys[j]].lastUsed)
+	})
+	for _, k := range keys {
+		if c.bytes <= c.maxBytes {
+			break
+		}
+		c.evictions++
+		c.evicted += c.entries[k].size
+		c.drop(k)
+	}
+}
+
+// drop forgets an entry and deletes its file. Callers must hold c.mu.
+func (c *Cache) drop(key string) {
+	if e := c.entries[key]; e != nil {
+		c.bytes -= e.size
+		delete(c.entries, key)
+	}
+	_ = os.Remove(c.path(key))
+}
+
+func (c *Cache) path(key string) string {
+	return filepath.Join(c.dir, key)
+}
+
+// linkOrCopy hard-links src to dst, copying when the two are on different
+// file systems.
+func linkOrCopy(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := dst + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+	}
+	return err
+}
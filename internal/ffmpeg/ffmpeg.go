@@ -11,6 +11,11 @@ import (
 	"time"
 )
 
+// Demuxers lists the input formats ffmpeg and ffprobe may open: the ones
+// uploads and outputs come in. Others, such as hls and concat playlists,
+// would read further files named in the input.
+const Demuxers = "mp3,aac,mov,matroska,ogg,flac,wav"
+
 func FindBinary() string {
 	return find("ffmpeg")
 }
@@ -24,17 +29,53 @@ func Duration(ffmpegBinary, path string) (time.Duration, error) {
 		}
 	}
 
-	var buf bytes.Buffer
-	cmd := exec.Command(probe, "-v", "error", "-show_entries", "format=duration", "-of", "csv=p=0", path)
+	// Prefer the first audio stream's duration: in video containers the
+	// format duration can cover a longer video stream. Matroska stores no
+	// stream durations, so fall back to the format's.
+	var buf, stderr bytes.Buffer
+	cmd := exec.Command(probe, "-v", "error", "-protocol_whitelist", "file", "-format_whitelist", Demuxers, "-select_streams", "a:0",
+		"-show_entries", "stream=duration:format=duration", "-of", "default=noprint_wrappers=1", path)
 	cmd.Stdout = &buf
+	cmd.Stderr = &stderr
 	if err := cmd.Run(); err != nil {
-		return 0, fmt.Errorf("ffprobe: %w", err)
+		return 0, &ProbeError{Err: err, Stderr: strings.TrimSpace(stderr.String())}
 	}
-	secs, err := strconv.ParseFloat(strings.TrimSpace(buf.String()), 64)
-	if err != nil {
+	var best float64
+	for _, line := range strings.Split(buf.String(), "\n") {
+		v, ok := strings.CutPrefix(strings.TrimSpace(line), "duration=")
+		if !ok {
+			continue
+		}
+		if secs, err := strconv.ParseFloat(v, 64); err == nil && secs > 0 {
+			best = secs
+			break
+		}
+	}
+	if best == 0 {
 		return 0, fmt.Errorf("ffprobe: invalid duration %q", buf.String())
 	}
-	return time.Duration(secs * float64(time.Second)), nil
+	return time.Duration(best * float64(time.Second)), nil
+}
+
+// ProbeError is a failed ffprobe run and what it wrote to stderr.
+type ProbeError struct {
+	Err    error
+	Stderr string
+}
+
+func (e *ProbeError) Error() string { return "ffprobe: " + e.Err.Error() }
+
+func (e *ProbeError) Unwrap() error { return e.Err }
+
+// Version returns the first line of `ffmpeg -version`, which identifies the
+// build closely enough to tell whether its output may differ.
+func Version(ffmpegBinary string) (string, error) {
+	out, err := exec.Command(ffmpegBinary, "-version").Output()
+	if err != nil {
+		return "", fmt.Errorf("ffmpeg -version: %w", err)
+	}
+	line, _, _ := strings.Cut(string(out), "\n")
+	return strings.TrimSpace(line), nil
 }
 
 func find(name string) string {
@@ -65,4 +106,3 @@ func searchDirs() []string {
 	}
 	return dirs
 }
-
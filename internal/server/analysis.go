@@ -0,0 +1,334 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"copyrem/internal/cache"
+	"copyrem/pipeline"
+)
+
+var errInputGone = errors.New("the input is only kept for jobs created with analyze=true")
+
+// analysisRequest names one artifact: a waveform or spectrogram of a job's
+// input or of one of its outputs.
+type analysisRequest struct {
+	kind     string // "waveform" or "spectrogram"
+	output   *JobOutput
+	waveform pipeline.WaveformOptions
+	spectrum pipeline.SpectrogramOptions
+}
+
+func (a analysisRequest) spec() string {
+	if a.kind == "waveform" {
+		w := a.waveform
+		return fmt.Sprintf("waveform:spp=%d:pixels=%d:bits=%d", w.SamplesPerPixel, w.Pixels, w.Bits)
+	}
+	s := a.spectrum
+	return fmt.Sprintf("spectrogram:%dx%d:legend=%t", s.Width, s.Height, s.Legend)
+}
+
+func (a analysisRequest) ext() string {
+	if a.kind == "waveform" {
+		return ".json"
+	}
+	return ".png"
+}
+
+// Analyzer produces waveforms and spectrograms for jobs. Artifacts are kept
+// with the job's files and, when their source has a content key, in the
+// result cache.
+type Analyzer struct {
+	store   *JobStore
+	results *cache.Cache
+	// base holds the backend, binary and limits analyses run with.
+	base pipeline.Options
+
+	mu      sync.Mutex
+	running map[string]*analysisCall
+}
+
+type analysisCall struct {
+	done chan struct{}
+	err  error
+}
+
+func NewAnalyzer(store *JobStore, results *cache.Cache, base pipeline.Options) *Analyzer {
+	return &Analyzer{store: store, results: results, base: base, running: make(map[string]*analysisCall)}
+}
+
+// Artifact returns the path of the requested artifact, producing it first
+// if needed. Concurrent requests for the same artifact share one run.
+func (a *Analyzer) Artifact(job *Job, req analysisRequest) (string, error) {
+	src, key := job.InPath, "input:"+job.InputSHA256
+	if req.output != nil {
+		src, key = req.output.Path, "output:"+req.output.CacheKey
+		if req.output.CacheKey == "" {
+			key = ""
+		}
+	} else if !job.Analyze {
+		return "", errInputGone
+	}
+	name := req.output.name() + ":" + req.spec()
+	if p, ok := a.store.artifact(job.ID, name); ok {
+		return p, nil
+	}
+	path := filepath.Join(filepath.Dir(job.InPath), "copyrem-"+job.ID+"-"+shortHash(name)+req.ext())
+
+	a.mu.Lock()
+	if c, ok := a.running[path]; ok {
+		a.mu.Unlock()
+		<-c.done
+		return path, c.err
+	}
+	c := &analysisCall{done: make(chan struct{})}
+	a.running[path] = c
+	a.mu.Unlock()
+
+	var cacheKey string
+	if key != "" && job.InputSHA256 != "" {
+		sum := sha256.Sum256([]byte(key + "\x00" + req.spec()))
+		cacheKey = hex.EncodeToString(sum[:])
+	}
+	c.err = a.produce(job, req, src, path, cacheKey)
+	if c.err == nil && !a.store.addArtifact(job.ID, name, path) {
+		_ = os.Remove(path)
+		c.err = errJobNotFound
+	}
+	a.mu.Lock()
+	delete(a.running, path)
+	a.mu.Unlock()
+	close(c.done)
+	return path, c.err
+}
+
+func (a *Analyzer) produce(job *Job, req analysisRequest, src, path, cacheKey string) error {
+	if cacheKey != "" && a.results != nil && a.results.Get(cacheKey, path) {
+		return nil
+	}
+	opts := pipeline.Options{Params: job.Params, Backend: a.base.Backend, Binary: a.base.Binary, Limits: a.base.Limits}
+	if req.kind == "waveform" {
+		wf, err := pipeline.Peaks(job.Ctx, src, opts, req.waveform)
+		if err != nil {
+			return err
+		}
+		b, err := json.Marshal(wf)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, b, 0o600); err != nil {
+			return err
+		}
+	} else if err := pipeline.Spectrogram(job.Ctx, src, path, opts, req.spectrum); err != nil {
+		_ = os.Remove(path)
+		return err
+	}
+	if cacheKey != "" && a.results != nil {
+		if err := a.results.Put(cacheKey, path); err != nil {
+			log.Printf("job %s: cache put: %v", job.ID, err)
+		}
+	}
+	return nil
+}
+
+// Precompute produces the default waveform and spectrogram of a job's
+// input and outputs, for jobs created with analyze=true. The tracks of a
+// split job are left to be analyzed on request.
+func (a *Analyzer) Precompute(job *Job) {
+	reqs := []analysisRequest{
+		{kind: "waveform", waveform: pipeline.DefaultWaveformOptions()},
+		{kind: "spectrogram", spectrum: pipeline.DefaultSpectrogramOptions()},
+	}
+	sources := []*JobOutput{nil}
+	if job.Tracks == nil {
+		for i := range job.Outputs {
+			sources = append(sources, &job.Outputs[i])
+		}
+	}
+	for _, out := range sources {
+		for _, req := range reqs {
+			req.output = out
+			if _, err := a.Artifact(job, req); err != nil {
+				if job.Ctx.Err() == nil {
+					log.Printf("job %s: %s: %v", job.ID, req.spec(), err)
+				}
+				return
+			}
+		}
+	}
+}
+
+func (o *JobOutput) name() string {
+	if o == nil {
+		return "input"
+	}
+	return fmt.Sprintf("%s/%d", o.Rendition.Name, o.Track)
+}
+
+func (s *JobStore) artifact(id, name string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	j := s.jobs[id]
+	if j == nil {
+		return "", false
+	}
+	p, ok := j.artifacts[name]
+	return p, ok
+}
+
+// addArtifact records an artifact file so it is removed with the job. It
+// reports false if the job is gone.
+func (s *JobStore) addArtifact(id, name, path string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j := s.jobs[id]
+	if j == nil {
+		return false
+	}
+	if j.artifacts == nil {
+		j.artifacts = make(map[string]string)
+	}
+	j.artifacts[name] = path
+	return true
+}
+
+// serveAnalysis serves GET /api/jobs/{id}/waveform and /spectrogram. Query:
+// source (input or output, the default), rendition and track to pick an
+// output, samples_per_pixel or pixels and bits for waveforms, width, height
+// and legend for spectrograms.
+func serveAnalysis(w http.ResponseWriter, r *http.Request, analyzer *Analyzer, job *Job, kind string) {
+	q := r.URL.Query()
+	req := analysisRequest{kind: kind}
+	switch q.Get("source") {
+	case "", "output":
+		ev, ok := analyzer.store.Event(job.ID)
+		if !ok || ev.Status != JobDone {
+			writeError(w, http.StatusConflict, "job not ready")
+			return
+		}
+		out, ok := job.outputFor(q.Get("rendition"), q.Get("track"))
+		if !ok {
+			writeError(w, http.StatusNotFound, "output not found")
+			return
+		}
+		req.output = &out
+	case "input":
+	default:
+		writeError(w, http.StatusBadRequest, "source must be input or output")
+		return
+	}
+
+	var err error
+	if kind == "waveform" {
+		req.waveform, err = waveformOptions(q)
+	} else {
+		req.spectrum, err = spectrogramOptions(q)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	path, err := analyzer.Artifact(job, req)
+	switch {
+	case errors.Is(err, errInputGone):
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	case err != nil:
+		if !errors.Is(err, pipeline.ErrInvalidOptions) {
+			log.Printf("job %s: %s: %v", job.ID, req.spec(), err)
+		}
+		writeFailure(w, err)
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "job not found")
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to read analysis")
+		return
+	}
+	if kind == "waveform" {
+		w.Header().Set("Content-Type", "application/json")
+	} else {
+		w.Header().Set("Content-Type", "image/png")
+	}
+	w.Header().Set("ETag", strconv.Quote(job.ID+"-"+shortHash(req.output.name()+":"+req.spec())))
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	http.ServeContent(w, r, "", fi.ModTime(), f)
+}
+
+// outputFor finds an output by rendition name and, for split jobs, track
+// number; empty values select the first.
+func (j *Job) outputFor(rendition, track string) (JobOutput, bool) {
+	n := 0
+	if track != "" {
+		var err error
+		if n, err = strconv.Atoi(track); err != nil {
+			return JobOutput{}, false
+		}
+	}
+	for _, o := range j.Outputs {
+		if (rendition == "" || o.Rendition.Name == rendition) && (n == 0 || o.Track == n) {
+			return o, true
+		}
+	}
+	return JobOutput{}, false
+}
+
+func waveformOptions(q url.Values) (pipeline.WaveformOptions, error) {
+	w := pipeline.DefaultWaveformOptions()
+	var err error
+	get := func(name string, dst *int) {
+		if v := q.Get(name); v != "" && err == nil {
+			if *dst, err = strconv.Atoi(v); err != nil {
+				err = fmt.Errorf("invalid %s", name)
+			}
+		}
+	}
+	if q.Get("pixels") != "" {
+		w.SamplesPerPixel = 0
+	}
+	get("samples_per_pixel", &w.SamplesPerPixel)
+	get("pixels", &w.Pixels)
+	get("bits", &w.Bits)
+	return w, err
+}
+
+func spectrogramOptions(q url.Values) (pipeline.SpectrogramOptions, error) {
+	s := pipeline.DefaultSpectrogramOptions()
+	for _, f := range []struct {
+		name string
+		dst  *int
+	}{{"width", &s.Width}, {"height", &s.Height}} {
+		if v := q.Get(f.name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return s, fmt.Errorf("invalid %s", f.name)
+			}
+			*f.dst = n
+		}
+	}
+	if v := q.Get("legend"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return s, fmt.Errorf("invalid legend")
+		}
+		s.Legend = b
+	}
+	return s, nil
+}
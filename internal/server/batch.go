@@ -0,0 +1,381 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"copyrem/pipeline"
+)
+
+// Batch groups jobs created from one multi-file upload.
+type Batch struct {
+	ID        string
+	Owner     string
+	JobIDs    []string
+	CreatedAt time.Time
+}
+
+type BatchStatus struct {
+	BatchID string          `json:"batch_id"`
+	Status  JobStatus       `json:"status"`
+	Percent int             `json:"percent"`
+	Total   int             `json:"total"`
+	Done    int             `json:"done"`
+	Failed  int             `json:"failed"`
+	Jobs    []BatchJobEntry `json:"jobs"`
+}
+
+type BatchJobEntry struct {
+	JobID   string    `json:"job_id"`
+	Path    string    `json:"path"`
+	Status  JobStatus `json:"status"`
+	Percent int       `json:"percent"`
+	Error   string    `json:"error,omitempty"`
+	// ErrorCode classifies Error.
+	ErrorCode pipeline.Code `json:"error_code,omitempty"`
+}
+
+func (s *JobStore) CreateBatch(owner string, jobIDs []string) *Batch {
+	b := &Batch{ID: randHex(8), Owner: owner, JobIDs: jobIDs, CreatedAt: time.Now()}
+	s.mu.Lock()
+	s.batches[b.ID] = b
+	for _, id := range jobIDs {
+		if j := s.jobs[id]; j != nil {
+			j.BatchID = b.ID
+		}
+	}
+	s.mu.Unlock()
+	return b
+}
+
+// OwnedBatch returns a batch if it belongs to owner.
+func (s *JobStore) OwnedBatch(id, owner string) *Batch {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	b := s.batches[id]
+	if b == nil || owner == "" || b.Owner != owner {
+		return nil
+	}
+	return b
+}
+
+// BatchStatus aggregates the state of a batch's jobs. Jobs that have been
+// removed before finishing count as cancelled.
+func (s *JobStore) BatchStatus(b *Batch) BatchStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	st := BatchStatus{BatchID: b.ID, Total: len(b.JobIDs), Status: JobDone}
+	sum, finished, running := 0, 0, false
+	for _, id := range b.JobIDs {
+		e := BatchJobEntry{JobID: id, Status: JobCancelled}
+		if j := s.jobs[id]; j != nil {
+			e.Path = path.Join(j.RelDir, j.InputName)
+			e.Status = j.Status
+			e.Percent = j.Percent
+			e.Error, e.ErrorCode = j.Error, j.ErrorCode
+		}
+		switch e.Status {
+		case JobDone:
+			st.Done++
+			finished++
+			e.Percent = 100
+		case JobFailed, JobCancelled:
+			st.Failed++
+			finished++
+		case JobRunning, JobPaused:
+			running = true
+		}
+		sum += e.Percent
+		if e.Status == JobFailed || e.Status == JobCancelled {
+			sum += 100 - e.Percent
+		}
+		st.Jobs = append(st.Jobs, e)
+	}
+	if st.Total > 0 {
+		st.Percent = sum / st.Total
+	}
+	switch {
+	case finished < st.Total && running:
+		st.Status = JobRunning
+	case finished < st.Total:
+		st.Status = JobPending
+	case st.Done == 0:
+		st.Status = JobFailed
+	}
+	return st
+}
+
+func (st BatchStatus) Terminal() bool {
+	return st.Status == JobDone || st.Status == JobFailed
+}
+
+// CancelBatch cancels every job in the batch and forgets the batch.
+func (s *JobStore) CancelBatch(b *Batch) {
+	for _, id := range b.JobIDs {
+		s.Cancel(id)
+	}
+	s.mu.Lock()
+	delete(s.batches, b.ID)
+	s.mu.Unlock()
+}
+
+// pruneBatches drops batches whose jobs have all been removed. Callers must
+// hold s.mu.
+func (s *JobStore) pruneBatches() {
+	for id, b := range s.batches {
+		live := false
+		for _, jid := range b.JobIDs {
+			if s.jobs[jid] != nil {
+				live = true
+				break
+			}
+		}
+		if !live {
+			delete(s.batches, id)
+		}
+	}
+}
+
+// BatchHandler serves POST /convert/batch, which takes any number of "file"
+// fields (audio or zip archives) sharing the same intensity, renditions and
+// segment. Segments are checked against each file's duration when its job
+// runs. Jobs start from base, as in ConvertHandler.
+func BatchHandler(base pipeline.Options, runner *Runner) http.HandlerFunc {
+	store := runner.store
+	cfg := base.Params
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		owner, err := ensureOwner(w, r)
+		if err != nil {
+			writeError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		ups, err := ParseBatchUpload(w, r)
+		if err != nil {
+			writeError(w, uploadStatus(err), err.Error())
+			return
+		}
+		opts := base
+		renditions := make([][]pipeline.Rendition, len(ups))
+		for i, up := range ups {
+			if renditions[i], err = parseRenditions(cfg, r.FormValue("renditions"), filepath.Ext(up.Path)); err != nil {
+				if len(ups) > 1 {
+					err = fmt.Errorf("%s: %w", path.Join(up.RelDir, up.BaseName+filepath.Ext(up.Path)), err)
+				}
+				break
+			}
+		}
+		if err == nil {
+			opts.Intensity, err = parseIntensity(r, opts.Intensity)
+		}
+		if err == nil {
+			opts.Segment, err = parseSegment(r)
+		}
+		// Batches run behind interactive jobs unless asked otherwise.
+		var prio Priority
+		if err == nil {
+			prio, err = parsePriority(r, PriorityLow)
+		}
+		if err == nil && (r.FormValue("split") != "" || len(r.MultipartForm.File["tracks"]) > 0) {
+			err = fmt.Errorf("split is not supported for batches")
+		}
+		if err == nil {
+			err = opts.Validate()
+		}
+		if err == nil && (opts.Segment.Start != 0 || opts.Segment.End != 0) && slices.ContainsFunc(renditions, hasVideo) {
+			err = fmt.Errorf("the video rendition cannot be trimmed")
+		}
+		if err != nil {
+			removeUploads(ups)
+			writeRequestError(w, err)
+			return
+		}
+		analyze, _ := strconv.ParseBool(r.FormValue("analyze"))
+		quality, _ := strconv.ParseBool(r.FormValue("quality"))
+		if err := checkAnalysis(opts.Backend, analyze, quality, nil); err != nil {
+			removeUploads(ups)
+			writeRequestError(w, err)
+			return
+		}
+
+		jobs := make([]*Job, len(ups))
+		ids := make([]string, len(ups))
+		for i, up := range ups {
+			jobs[i] = store.Create(JobSpec{
+				Owner:       owner,
+				InPath:      up.Path,
+				Outputs:     newJobOutputs(filepath.Dir(up.Path), up.BaseName, renditions[i]),
+				RelDir:      up.RelDir,
+				InputName:   up.BaseName + filepath.Ext(up.Path),
+				InputBytes:  up.Size,
+				InputSHA256: up.SHA256,
+				Params:      opts.Params,
+				Intensity:   opts.Intensity,
+				Segment:     opts.Segment,
+				Analyze:     analyze,
+				Quality:     quality,
+				Priority:    prio,
+				Client:      queueClient(r, owner),
+			})
+			ids[i] = jobs[i].ID
+		}
+		batch := store.CreateBatch(owner, ids)
+		for _, job := range jobs {
+			runner.Enqueue(job, opts)
+		}
+
+		writeJSON(w, http.StatusOK, struct {
+			BatchID string   `json:"batch_id"`
+			JobIDs  []string `json:"job_ids"`
+		}{batch.ID, ids})
+	}
+}
+
+func removeUploads(ups []*Upload) {
+	for _, up := range ups {
+		_ = os.Remove(up.Path)
+	}
+}
+
+// BatchStatusHandler serves the batch sub-resources:
+//
+//	GET  /convert/batch/{id}           aggregate and per-file status
+//	GET  /convert/batch/{id}/progress  the same as an SSE stream
+//	GET  /convert/batch/{id}/download  zip of all finished outputs
+//	POST /convert/batch/{id}/cancel    cancel every job
+func BatchStatusHandler(store *JobStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		owner, ok := jobOwner(w, r)
+		if !ok {
+			return
+		}
+		id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/convert/batch/"), "/")
+		b := store.OwnedBatch(id, owner)
+		if b == nil {
+			writeError(w, http.StatusNotFound, "batch not found")
+			return
+		}
+
+		want := http.MethodGet
+		if action == "cancel" {
+			want = http.MethodPost
+		}
+		if r.Method != want {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		switch action {
+		case "":
+			writeJSON(w, http.StatusOK, store.BatchStatus(b))
+		case "progress":
+			streamBatch(w, r, store, b)
+		case "download":
+			serveBatchZip(w, store, b)
+		case "cancel":
+			store.CancelBatch(b)
+			writeJSON(w, http.StatusOK, struct {
+				Cancelled bool `json:"cancelled"`
+			}{true})
+		default:
+			writeError(w, http.StatusNotFound, "not found")
+		}
+	}
+}
+
+// streamBatch sends a "progress" event whenever any job in the batch
+// changes, and a final "done" or "failed" event.
+func streamBatch(w http.ResponseWriter, r *http.Request, store *JobStore, b *Batch) {
+	sse, ok := newSSEWriter(w)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+
+	changes := make(chan struct{}, 1)
+	for _, id := range b.JobIDs {
+		ch, unsubscribe, ok := store.Subscribe(id)
+		if !ok {
+			continue
+		}
+		defer unsubscribe()
+		go func() {
+			for range ch {
+				select {
+				case changes <- struct{}{}:
+				default:
+				}
+			}
+		}()
+	}
+
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+	var seq uint64
+	for {
+		st := store.BatchStatus(b)
+		seq++
+		name := "progress"
+		if st.Terminal() {
+			name = string(st.Status)
+		}
+		if err := sse.event(seq, name, st); err != nil || st.Terminal() {
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-changes:
+		case <-heartbeat.C:
+			if err := sse.heartbeat(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// serveBatchZip streams every finished output, keeping each input's folder
+// from the uploaded archive.
+func serveBatchZip(w http.ResponseWriter, store *JobStore, b *Batch) {
+	var entries []zipEntry
+	used := make(map[string]bool)
+	for _, id := range b.JobIDs {
+		j := store.snapshot(id)
+		if ev, ok := store.Event(id); j == nil || !ok || ev.Status != JobDone {
+			continue
+		}
+		for _, o := range j.Outputs {
+			entries = append(entries, zipEntry{path: o.Path, name: uniqueName(used, path.Join(j.RelDir, o.Filename))})
+		}
+	}
+	if len(entries) == 0 {
+		writeError(w, http.StatusConflict, "no finished outputs yet")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "batch_"+b.ID+".zip"))
+	w.Header().Set("Cache-Control", "private, no-transform")
+	writeZip(w, b.ID, entries)
+}
+
+// uniqueName numbers duplicate archive names: "a.mp3", "a (2).mp3", ...
+func uniqueName(used map[string]bool, name string) string {
+	candidate := name
+	ext := path.Ext(name)
+	for n := 2; used[candidate]; n++ {
+		candidate = fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), n, ext)
+	}
+	used[candidate] = true
+	return candidate
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	MaxBatchUploadMB = 500
+	MaxBatchFiles    = 100
+)
+
+// ParseBatchUpload saves every "file" in the form. Zip archives are unpacked
+// and their audio files kept with their folder structure; anything else in
+// an archive is skipped.
+func ParseBatchUpload(w http.ResponseWriter, r *http.Request) ([]*Upload, error) {
+	if err := parseMultipart(w, r, MaxBatchUploadMB); err != nil {
+		return nil, err
+	}
+	fhs := r.MultipartForm.File["file"]
+	if len(fhs) == 0 {
+		return nil, uploadError{http.StatusBadRequest, fmt.Errorf("missing file")}
+	}
+
+	var ups []*Upload
+	fail := func(err error) ([]*Upload, error) {
+		for _, up := range ups {
+			_ = os.Remove(up.Path)
+		}
+		return nil, err
+	}
+	budget := int64(MaxBatchUploadMB) * 1024 * 1024
+	for _, fh := range fhs {
+		ext := strings.ToLower(filepath.Ext(fh.Filename))
+		if ext != ".zip" && !allowedExtension(ext) {
+			return fail(uploadError{http.StatusBadRequest, fmt.Errorf("unsupported format %q. Allowed: %s, .zip", fh.Filename, allowedExtensionsStr)})
+		}
+		f, err := fh.Open()
+		if err != nil {
+			return fail(uploadError{http.StatusInternalServerError, fmt.Errorf("failed to read upload")})
+		}
+		var got []*Upload
+		if ext == ".zip" {
+			got, err = extractArchive(f, fh.Size, &budget)
+		} else {
+			var up *Upload
+			if up, err = saveUpload(f, fh.Filename); err == nil {
+				got = []*Upload{up}
+			}
+		}
+		f.Close()
+		ups = append(ups, got...)
+		if err != nil {
+			return fail(err)
+		}
+		if len(ups) > MaxBatchFiles {
+			return fail(uploadError{http.StatusRequestEntityTooLarge, fmt.Errorf("too many files (max %d)", MaxBatchFiles)})
+		}
+	}
+	if len(ups) == 0 {
+		return nil, uploadError{http.StatusBadRequest, fmt.Errorf("no audio files found")}
+	}
+	return ups, nil
+}
+
+// extractArchive saves the audio files in a zip, charging their uncompressed
+// size against budget so a small archive cannot expand without bound.
+func extractArchive(f multipart.File, size int64, budget *int64) ([]*Upload, error) {
+	zr, err := zip.NewReader(f, size)
+	if err != nil {
+		return nil, uploadError{http.StatusBadRequest, fmt.Errorf("invalid zip archive")}
+	}
+	var ups []*Upload
+	fail := func(err error) ([]*Upload, error) {
+		for _, up := range ups {
+			_ = os.Remove(up.Path)
+		}
+		return nil, err
+	}
+	for _, zf := range zr.File {
+		name := path.Clean(strings.ReplaceAll(zf.Name, "\\", "/"))
+		if zf.FileInfo().IsDir() || strings.HasPrefix(name, "__MACOSX/") || strings.HasPrefix(path.Base(name), ".") {
+			continue
+		}
+		if !allowedExtension(strings.ToLower(path.Ext(name))) {
+			continue
+		}
+		if len(ups) >= MaxBatchFiles {
+			return fail(uploadError{http.StatusRequestEntityTooLarge, fmt.Errorf("too many files (max %d)", MaxBatchFiles)})
+		}
+		if int64(zf.UncompressedSize64) > *budget {
+			return fail(uploadError{http.StatusRequestEntityTooLarge, fmt.Errorf("archive too large (max %d MB)", MaxBatchUploadMB)})
+		}
+		rc, err := zf.Open()
+		if err != nil {
+			return fail(uploadError{http.StatusBadRequest, fmt.Errorf("invalid zip entry %q", zf.Name)})
+		}
+		up, err := saveUpload(io.LimitReader(rc, *budget), path.Base(name))
+		rc.Close()
+		if err != nil {
+			return fail(err)
+		}
+		*budget -= up.Size
+		up.RelDir = safeRelDir(path.Dir(name))
+		ups = append(ups, up)
+	}
+	return ups, nil
+}
+
+// safeRelDir sanitizes each segment of an archive folder path, dropping
+// anything that could escape the archive root.
+func safeRelDir(dir string) string {
+	var parts []string
+	for _, seg := range strings.Split(dir, "/") {
+		if seg == "" || seg == "." || seg == ".." {
+			continue
+		}
+		parts = append(parts, safeDownloadFilename(seg))
+	}
+	return strings.Join(parts, "/")
+}
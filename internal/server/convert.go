@@ -1,63 +1,246 @@
 package server
 
 import (
-	"context"
 	"fmt"
-	"log"
+	"math"
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
 	"copyrem/internal/config"
-	"copyrem/internal/converter"
+	"copyrem/pipeline"
 )
 
-func ConvertHandler(cfg config.Params, store *JobStore) http.HandlerFunc {
+// ConvertHandler serves POST /convert. Jobs start from base, the server's
+// parameters, backend and limits.
+func ConvertHandler(base pipeline.Options, runner *Runner, previews *Pool, links *linkSigner) http.HandlerFunc {
+	store := runner.store
+	cfg := base.Params
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
 			return
 		}
-		inPath, baseName, err := ParseUpload(w, r)
+		owner, err := ensureOwner(w, r)
+		if err != nil {
+			writeError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		up, err := ParseUpload(w, r)
 		if err != nil {
 			writeError(w, uploadStatus(err), err.Error())
 			return
 		}
-		dir := filepath.Dir(inPath)
-		outPath := filepath.Join(dir, randHex(8)+".mp3")
-		job := store.Create(inPath, outPath, baseName+DownloadSuffix)
-
-		intensity := 1.0
-		if val := r.FormValue("intensity"); val != "" {
-			if f, err := strconv.ParseFloat(val, 64); err == nil {
-				intensity = f
-			}
+		inPath := up.Path
+		opts := base
+		preview, _ := strconv.ParseBool(r.FormValue("preview"))
+		analyze, _ := strconv.ParseBool(r.FormValue("analyze"))
+		quality, _ := strconv.ParseBool(r.FormValue("quality"))
+		var split *Split
+		prio, err := parsePriority(r, PriorityNormal)
+		if err == nil {
+			opts.Intensity, err = parseIntensity(r, opts.Intensity)
+		}
+		if err == nil {
+			opts.Segment, err = parseSegment(r)
+		}
+		if err == nil {
+			err = opts.Validate()
+		}
+		if err == nil {
+			split, err = parseSplit(r)
+		}
+		if err == nil && split != nil && (opts.Segment.Start != 0 || opts.Segment.End != 0) {
+			err = fmt.Errorf("start and end cannot be combined with split")
+		}
+		if err == nil && split != nil && quality {
+			err = fmt.Errorf("quality reports are not available for split jobs")
+		}
+		if err == nil {
+			err = checkAnalysis(opts.Backend, analyze, quality, split)
+		}
+		if err == nil {
+			err = checkInput(inPath, opts, split)
+		}
+		if err == nil && preview {
+			opts.Segment, err = previewSegment(r, opts.Segment)
+		}
+		if err != nil {
+			_ = os.Remove(inPath)
+			writeRequestError(w, err)
+			return
 		}
 
-		go func() {
-			store.SetRunning(job.ID)
-			err := converter.ConvertWithProgress(job.Ctx, cfg, inPath, outPath, intensity, func(pct int) {
-				store.SetPercent(job.ID, pct)
-			})
+		renditions, err := parseRenditions(cfg, r.FormValue("renditions"), filepath.Ext(inPath))
+		if err == nil && !preview && (split != nil || opts.Segment.Start != 0 || opts.Segment.End != 0) && hasVideo(renditions) {
+			err = fmt.Errorf("the video rendition cannot be trimmed or split")
+		}
+		if err != nil {
 			_ = os.Remove(inPath)
-			if err != nil {
-				if job.Ctx.Err() == context.Canceled {
-					return
-				}
-				log.Printf("job %s failed: %v", job.ID, err)
-				store.SetFailed(job.ID, err.Error())
-				return
-			}
-			store.SetDone(job.ID)
-		}()
+			writeRequestError(w, err)
+			return
+		}
+		if preview {
+			servePreview(w, r, previews, inPath, previewRendition(cfg, renditions), opts)
+			return
+		}
+		maxDownloads, _ := strconv.Atoi(r.FormValue("max_downloads"))
+		outputs := newJobOutputs(filepath.Dir(inPath), up.BaseName, renditions)
+		if split != nil && split.List != nil {
+			outputs = newTrackOutputs(filepath.Dir(inPath), *split.List, renditions)
+		}
+
+		job := store.Create(JobSpec{
+			Owner:        owner,
+			InPath:       inPath,
+			Outputs:      outputs,
+			InputName:    up.BaseName + filepath.Ext(inPath),
+			InputBytes:   up.Size,
+			InputSHA256:  up.SHA256,
+			Params:       opts.Params,
+			Intensity:    opts.Intensity,
+			Segment:      opts.Segment,
+			Split:        split,
+			Analyze:      analyze,
+			Quality:      quality,
+			MaxDownloads: maxDownloads,
+			Priority:     prio,
+			Client:       queueClient(r, owner),
+		})
+
+		runner.Enqueue(job, opts)
 
 		writeJSON(w, http.StatusOK, struct {
-			JobID string `json:"job_id"`
-		}{job.ID})
+			JobID       string `json:"job_id"`
+			DownloadURL string `json:"download_url"`
+		}{job.ID, links.URL(job.ID, time.Now().Add(store.LinkLifetime()), false)})
+	}
+}
+
+// checkAnalysis rejects the options that analyze audio, which needs ffmpeg,
+// when the backend doesn't offer analyses.
+func checkAnalysis(b pipeline.Backend, analyze, quality bool, split *Split) error {
+	if b == nil || b.Capabilities().Analysis {
+		return nil
+	}
+	switch {
+	case quality:
+		return fmt.Errorf("quality reports are not available with the %s backend", b.Name())
+	case analyze:
+		return fmt.Errorf("analysis is not available with the %s backend", b.Name())
+	case split != nil && split.Silence != nil:
+		return fmt.Errorf("split=silence is not available with the %s backend", b.Name())
+	}
+	return nil
+}
+
+// parseIntensity reads the intensity form field, which defaults to def.
+// Options.Validate checks its range.
+func parseIntensity(r *http.Request, def float64) (float64, error) {
+	v := r.FormValue("intensity")
+	if v == "" {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid intensity %q", v)
 	}
+	return f, nil
+}
+
+// parsePriority reads the priority form field, which defaults to def.
+func parsePriority(r *http.Request, def Priority) (Priority, error) {
+	v := r.FormValue("priority")
+	if v == "" {
+		return def, nil
+	}
+	return ParsePriority(v)
+}
+
+// parseRenditions reads a comma-separated rendition list such as
+// "mp3_320,flac,opus_96". Empty means the configured MP3 output. "video"
+// keeps the video of an input with extension ext.
+func parseRenditions(cfg config.Params, v, ext string) ([]pipeline.Rendition, error) {
+	if strings.TrimSpace(v) == "" {
+		return []pipeline.Rendition{cfg.DefaultRendition()}, nil
+	}
+	var out []pipeline.Rendition
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(v, ",") {
+		var r pipeline.Rendition
+		var err error
+		if strings.EqualFold(strings.TrimSpace(name), "video") {
+			if !isVideo(ext) {
+				return nil, fmt.Errorf("the video rendition needs a video input")
+			}
+			r, err = pipeline.VideoRendition(ext)
+		} else {
+			r, err = pipeline.ParseRendition(name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if seen[r.Name] {
+			continue
+		}
+		seen[r.Name] = true
+		out = append(out, r)
+	}
+	if len(out) > MaxRenditions {
+		return nil, fmt.Errorf("at most %d renditions per job", MaxRenditions)
+	}
+	return out, nil
+}
+
+func hasVideo(renditions []pipeline.Rendition) bool {
+	return slices.ContainsFunc(renditions, pipeline.Rendition.IsVideo)
+}
+
+// parseSegment reads the optional start, end, fade_in and fade_out form
+// values, in seconds or as Go durations, and the trim_silence flag.
+func parseSegment(r *http.Request) (pipeline.Segment, error) {
+	var seg pipeline.Segment
+	for _, f := range []struct {
+		name string
+		dst  *time.Duration
+	}{
+		{"start", &seg.Start},
+		{"end", &seg.End},
+		{"fade_in", &seg.FadeIn},
+		{"fade_out", &seg.FadeOut},
+	} {
+		v := strings.TrimSpace(r.FormValue(f.name))
+		if v == "" {
+			continue
+		}
+		d, err := parseSeconds(v)
+		if err != nil {
+			return seg, fmt.Errorf("invalid %s: %q", f.name, v)
+		}
+		*f.dst = d
+	}
+	if v := r.FormValue("trim_silence"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return seg, fmt.Errorf("invalid trim_silence: %q", v)
+		}
+		seg.TrimSilence = b
+	}
+	return seg, nil
+}
+
+func parseSeconds(v string) (time.Duration, error) {
+	if f, err := strconv.ParseFloat(v, 64); err == nil {
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return 0, strconv.ErrSyntax
+		}
+		return time.Duration(f * float64(time.Second)), nil
+	}
+	return time.ParseDuration(v)
 }
 
 func ProgressHandler(store *JobStore) http.HandlerFunc {
@@ -67,50 +250,54 @@ func ProgressHandler(store *JobStore) http.HandlerFunc {
 			return
 		}
 
+		owner, ok := jobOwner(w, r)
+		if !ok {
+			return
+		}
 		id := strings.TrimPrefix(r.URL.Path, "/convert/progress/")
-		if id == "" || store.Get(id) == nil {
+		if id == "" || !store.Owns(id, owner) {
 			writeError(w, http.StatusNotFound, "job not found")
 			return
 		}
+		changes, unsubscribe, ok := store.Subscribe(id)
+		if !ok {
+			writeError(w, http.StatusNotFound, "job not found")
+			return
+		}
+		defer unsubscribe()
 
-		flusher, ok := w.(http.Flusher)
+		sse, ok := newSSEWriter(w)
 		if !ok {
 			writeError(w, http.StatusInternalServerError, "streaming not supported")
 			return
 		}
 
-		w.Header().Set("Content-Type", "text/event-stream")
-		w.Header().Set("Cache-Control", "no-cache")
-		w.Header().Set("Connection", "keep-alive")
-
-		ticker := time.NewTicker(500 * time.Millisecond)
-		defer ticker.Stop()
+		heartbeat := time.NewTicker(sseHeartbeat)
+		defer heartbeat.Stop()
 
+		lastID := lastEventID(r)
 		for {
-			select {
-			case <-r.Context().Done():
-				if j := store.Get(id); j != nil && j.Status != JobDone {
-					store.Cancel(id)
-				}
+			ev, ok := store.Event(id)
+			if !ok {
 				return
-			case <-ticker.C:
-				j := store.Get(id)
-				if j == nil {
+			}
+			if ev.ID > lastID {
+				if err := sse.event(ev.ID, ev.Type(), ev); err != nil {
 					return
 				}
+				lastID = ev.ID
+			}
+			if ev.Terminal() {
+				return
+			}
 
-				switch j.Status {
-				case JobDone:
-					fmt.Fprint(w, "data: {\"percent\":100,\"done\":true}\n\n")
-					flusher.Flush()
-					return
-				case JobFailed:
-					fmt.Fprintf(w, "data: {\"percent\":%d,\"error\":%q}\n\n", j.Percent, j.Error)
-					flusher.Flush()
+			select {
+			case <-r.Context().Done():
+				return
+			case <-changes:
+			case <-heartbeat.C:
+				if err := sse.heartbeat(); err != nil {
 					return
-				default:
-					fmt.Fprintf(w, "data: {\"percent\":%d}\n\n", j.Percent)
-					flusher.Flush()
 				}
 			}
 		}
@@ -124,39 +311,58 @@ func CancelHandler(store *JobStore) http.HandlerFunc {
 			return
 		}
 
+		owner, ok := jobOwner(w, r)
+		if !ok {
+			return
+		}
 		id := strings.TrimPrefix(r.URL.Path, "/convert/cancel/")
-		if id == "" || store.Get(id) == nil {
+		if id == "" || !store.Owns(id, owner) {
 			writeError(w, http.StatusNotFound, "job not found")
 			return
 		}
 
 		store.Cancel(id)
-		writeJSON(w, http.StatusOK, struct{ Cancelled bool `json:"cancelled"` }{true})
+		writeJSON(w, http.StatusOK, struct {
+			Cancelled bool `json:"cancelled"`
+		}{true})
 	}
 }
 
-func DownloadHandler(store *JobStore) http.HandlerFunc {
+// LinkHandler issues a signed download URL for a job. Form values: ttl (Go
+// duration, default and maximum the job's remaining lifetime) and single_use.
+func LinkHandler(store *JobStore, links *linkSigner) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
+		if r.Method != http.MethodPost {
 			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
 			return
 		}
 
-		id := strings.TrimPrefix(r.URL.Path, "/convert/download/")
-		job := store.Get(id)
-		if job == nil {
-			writeError(w, http.StatusNotFound, "job not found")
+		owner, ok := jobOwner(w, r)
+		if !ok {
 			return
 		}
-		if job.Status != JobDone {
-			writeError(w, http.StatusConflict, "job not ready")
+		id := strings.TrimPrefix(r.URL.Path, "/convert/link/")
+		if id == "" || !store.Owns(id, owner) {
+			writeError(w, http.StatusNotFound, "job not found")
 			return
 		}
 
-		w.Header().Set("Content-Type", "audio/mpeg")
-		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", job.OriginalName))
-		http.ServeFile(w, r, job.OutPath)
+		ttl := store.LinkLifetime()
+		if v := r.FormValue("ttl"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				writeError(w, http.StatusBadRequest, "invalid ttl")
+				return
+			}
+			ttl = min(d, ttl)
+		}
+		single, _ := strconv.ParseBool(r.FormValue("single_use"))
+		expires := time.Now().Add(ttl)
 
-		store.Cancel(id)
+		writeJSON(w, http.StatusOK, struct {
+			URL       string    `json:"url"`
+			ExpiresAt time.Time `json:"expires_at"`
+			SingleUse bool      `json:"single_use"`
+		}{links.URL(id, expires, single), expires.UTC().Truncate(time.Second), single})
 	}
 }
@@ -0,0 +1,384 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"copyrem/pipeline"
+)
+
+// leasePoll is how long a worker asking for a lease waits for a job before
+// it is told to ask again.
+const leasePoll = 25 * time.Second
+
+// errLeaseExpired fails the attempt of a job whose worker stopped sending
+// heartbeats, so that the retry policy hands it to another.
+var errLeaseExpired = &remoteError{msg: "worker lease expired", code: pipeline.CodeInternal, transient: true}
+
+// errUnclaimed puts a job back in the queue when the worker it was taken for
+// stopped waiting before it could be leased.
+var errUnclaimed = errors.New("worker stopped waiting for a lease")
+
+// Coordinator leases queued jobs to remote workers (copyrem worker). A worker
+// takes a lease, downloads the input, uploads the outputs and completes the
+// lease, reporting its progress in heartbeats meanwhile. Everything else a
+// job does, from the cache to quality reports, happens on the coordinator.
+type Coordinator struct {
+	runner *Runner
+	token  string
+	// ttl is how long a lease lasts without a heartbeat.
+	ttl time.Duration
+
+	mu     sync.Mutex
+	leases map[string]*lease
+}
+
+type lease struct {
+	id     string
+	job    *Job
+	worker string
+	assign assignment
+	beat   chan struct{}
+	done   chan error
+}
+
+// NewCoordinator hands out runner's jobs to workers that present
+// WORKER_TOKEN. Leases last WORKER_LEASE_TTL (default 30s) past the last
+// heartbeat.
+func NewCoordinator(runner *Runner) *Coordinator {
+	return newCoordinator(runner, os.Getenv("WORKER_TOKEN"), envDuration("WORKER_LEASE_TTL", 30*time.Second))
+}
+
+func newCoordinator(runner *Runner, token string, ttl time.Duration) *Coordinator {
+	return &Coordinator{
+		runner: runner,
+		token:  token,
+		ttl:    ttl,
+		leases: make(map[string]*lease),
+	}
+}
+
+// assignment tells a worker what to do with a leased job.
+type assignment struct {
+	Lease    string `json:"lease"`
+	JobID    string `json:"job_id"`
+	InputExt string `json:"input_ext"`
+	// HeartbeatSeconds is how often the worker should report progress.
+	HeartbeatSeconds float64             `json:"heartbeat_seconds"`
+	Params           pipeline.Params     `json:"params"`
+	Intensity        float64             `json:"intensity"`
+	Segment          pipeline.Segment    `json:"segment"`
+	Metadata         map[string]string   `json:"metadata,omitempty"`
+	Tracks           *pipeline.TrackList `json:"tracks,omitempty"`
+	Outputs          []remoteOutput      `json:"outputs"`
+}
+
+type remoteOutput struct {
+	Rendition pipeline.Rendition `json:"rendition"`
+	Track     int                `json:"track,omitempty"`
+	Name      string             `json:"name"`
+}
+
+// completion ends a lease. An empty Error means the outputs are uploaded.
+type completion struct {
+	Error     string        `json:"error,omitempty"`
+	Code      pipeline.Code `json:"code,omitempty"`
+	Transient bool          `json:"transient,omitempty"`
+}
+
+// remoteError is a failure a worker reported, as the worker classified it.
+type remoteError struct {
+	msg       string
+	code      pipeline.Code
+	transient bool
+}
+
+func (e *remoteError) Error() string       { return e.msg }
+func (e *remoteError) Code() pipeline.Code { return e.code }
+func (e *remoteError) Transient() bool     { return e.transient }
+
+// WorkerHandler serves the API remote workers use, under /api/worker/:
+//
+//	POST /api/worker/lease?worker=name
+//	GET  /api/worker/leases/{lease}/input
+//	PUT  /api/worker/leases/{lease}/outputs/{i}
+//	POST /api/worker/leases/{lease}/heartbeat
+//	POST /api/worker/leases/{lease}/complete
+func WorkerHandler(c *Coordinator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if c.token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(c.token)) != 1 {
+			writeError(w, http.StatusUnauthorized, "invalid worker token")
+			return
+		}
+		rest := strings.TrimPrefix(r.URL.Path, "/api/worker/")
+		if rest == "lease" {
+			if r.Method != http.MethodPost {
+				writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+				return
+			}
+			c.takeLease(w, r)
+			return
+		}
+		parts := strings.Split(strings.TrimPrefix(rest, "leases/"), "/")
+		if !strings.HasPrefix(rest, "leases/") || len(parts) < 2 {
+			writeError(w, http.StatusNotFound, "not found")
+			return
+		}
+		l := c.lookup(parts[0])
+		if l == nil {
+			writeError(w, http.StatusGone, "lease expired")
+			return
+		}
+		method := http.MethodPost
+		switch parts[1] {
+		case "input":
+			method = http.MethodGet
+		case "outputs":
+			method = http.MethodPut
+		}
+		if r.Method != method {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		switch {
+		case parts[1] == "input" && len(parts) == 2:
+			serveLeaseInput(w, r, l)
+		case parts[1] == "outputs" && len(parts) == 3:
+			receiveLeaseOutput(w, r, l, parts[2])
+		case parts[1] == "heartbeat" && len(parts) == 2:
+			c.heartbeat(w, r, l)
+		case parts[1] == "complete" && len(parts) == 2:
+			c.complete(w, r, l)
+		default:
+			writeError(w, http.StatusNotFound, "not found")
+		}
+	}
+}
+
+// takeLease waits up to leasePoll for a job that needs converting and
+// leases it to the caller. A job leaves the queue only for a worker that is
+// waiting; if the worker is gone by the time the job is ready to convert, it
+// goes back. Tasks that aren't jobs, and jobs that finish without a worker,
+// such as those served from the cache, leave the worker waiting for the
+// next task.
+func (c *Coordinator) takeLease(w http.ResponseWriter, r *http.Request) {
+	worker := r.URL.Query().Get("worker")
+	ctx, cancel := context.WithTimeout(r.Context(), leasePoll)
+	defer cancel()
+	for {
+		t, ok := c.runner.pool.Take(ctx)
+		if !ok {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if t.Job == nil {
+			go t.Run()
+			continue
+		}
+		offered := make(chan *lease)
+		finished := make(chan struct{})
+		go func() {
+			defer close(finished)
+			c.run(t.Job, t.Opts, func(job *Job, opts pipeline.Options) error {
+				return c.dispatch(ctx, worker, job, opts, offered)
+			})
+		}()
+		select {
+		case l := <-offered:
+			writeJSON(w, http.StatusOK, l.assign)
+			return
+		case <-finished:
+		}
+	}
+}
+
+// run runs a job as the runner does, except that one no worker took is
+// queued again as if it had never started.
+func (c *Coordinator) run(job *Job, opts pipeline.Options, convert func(*Job, pipeline.Options) error) {
+	rn := c.runner
+	err := runJob(rn.store, rn.results, rn.analyzer, job, opts, convert)
+	switch {
+	case errors.Is(err, errUnclaimed):
+		rn.store.SetUnclaimed(job.ID)
+		rn.submit(job, opts)
+	case err != nil:
+		rn.fail(job, opts, err)
+	}
+}
+
+// dispatch stands in for converting a job: it offers a lease on it to the
+// worker waiting in takeLease and waits for the worker to complete it. The
+// lease expires after ttl without a heartbeat.
+func (c *Coordinator) dispatch(ctx context.Context, worker string, job *Job, opts pipeline.Options, offered chan<- *lease) error {
+	// A worker that lost an earlier lease may have uploaded some outputs.
+	for _, o := range job.Outputs {
+		_ = os.Remove(o.Path)
+	}
+	l := &lease{
+		id:     randHex(16),
+		job:    job,
+		worker: worker,
+		beat:   make(chan struct{}, 1),
+		done:   make(chan error, 1),
+	}
+	l.assign = newAssignment(l.id, job, opts, c.ttl)
+	c.mu.Lock()
+	c.leases[l.id] = l
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.leases, l.id)
+		c.mu.Unlock()
+	}()
+
+	select {
+	case offered <- l:
+	case <-ctx.Done():
+		return errUnclaimed
+	case <-job.Ctx.Done():
+		return job.Ctx.Err()
+	}
+	log.Printf("job %s leased to worker %s", job.ID, worker)
+	timer := time.NewTimer(c.ttl)
+	defer timer.Stop()
+	for {
+		select {
+		case err := <-l.done:
+			return err
+		case <-l.beat:
+			timer.Reset(c.ttl)
+		case <-timer.C:
+			log.Printf("job %s: lease of worker %s expired", job.ID, worker)
+			return errLeaseExpired
+		case <-job.Ctx.Done():
+			return job.Ctx.Err()
+		}
+	}
+}
+
+func newAssignment(id string, job *Job, opts pipeline.Options, ttl time.Duration) assignment {
+	a := assignment{
+		Lease:            id,
+		JobID:            job.ID,
+		InputExt:         filepath.Ext(job.InPath),
+		HeartbeatSeconds: ttl.Seconds() / 3,
+		Params:           opts.Params,
+		Intensity:        opts.Intensity,
+		Segment:          opts.Segment,
+		Metadata:         opts.Metadata,
+		Tracks:           job.Tracks,
+	}
+	for _, o := range job.Outputs {
+		a.Outputs = append(a.Outputs, remoteOutput{Rendition: o.Rendition, Track: o.Track, Name: filepath.Base(o.Path)})
+	}
+	return a
+}
+
+func (c *Coordinator) lookup(id string) *lease {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.leases[id]
+}
+
+func serveLeaseInput(w http.ResponseWriter, r *http.Request, l *lease) {
+	f, err := os.Open(l.job.InPath)
+	if err != nil {
+		writeError(w, http.StatusGone, "input has been removed")
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, "", fi.ModTime(), f)
+}
+
+func receiveLeaseOutput(w http.ResponseWriter, r *http.Request, l *lease, index string) {
+	i, err := strconv.Atoi(index)
+	if err != nil || i < 0 || i >= len(l.job.Outputs) {
+		writeError(w, http.StatusNotFound, "no such output")
+		return
+	}
+	// Outputs can take longer to send than the server's read timeout.
+	_ = http.NewResponseController(w).SetReadDeadline(time.Time{})
+	f, err := os.Create(l.job.Outputs[i].Path)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	_, err = io.Copy(f, r.Body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(l.job.Outputs[i].Path)
+		writeError(w, http.StatusBadRequest, "output upload: "+err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (c *Coordinator) heartbeat(w http.ResponseWriter, r *http.Request, l *lease) {
+	var p pipeline.Progress
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid progress")
+		return
+	}
+	c.runner.store.SetProgress(l.job.ID, p)
+	select {
+	case l.beat <- struct{}{}:
+	default:
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (c *Coordinator) complete(w http.ResponseWriter, r *http.Request, l *lease) {
+	var done completion
+	if err := json.NewDecoder(r.Body).Decode(&done); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid completion")
+		return
+	}
+	var err error
+	if done.Error != "" {
+		log.Printf("job %s failed on worker %s", l.job.ID, l.worker)
+		err = &remoteError{msg: done.Error, code: done.Code, transient: done.Transient}
+	} else if missing := missingOutput(l.job); missing != "" {
+		log.Printf("job %s: worker %s completed without output %s", l.job.ID, l.worker, missing)
+		err = &remoteError{msg: "worker did not upload " + missing, code: pipeline.CodeInternal, transient: true}
+	}
+	select {
+	case l.done <- err:
+	default:
+	}
+	if err != nil && done.Error == "" {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// missingOutput returns the name of an output of job that is missing or
+// empty, or "" if all were uploaded.
+func missingOutput(job *Job) string {
+	for _, o := range job.Outputs {
+		if fi, err := os.Stat(o.Path); err != nil || fi.Size() == 0 {
+			return filepath.Base(o.Path)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,247 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"copyrem/pipeline"
+)
+
+type testCoordinator struct {
+	*httptest.Server
+	coord  *Coordinator
+	store  *JobStore
+	runner *Runner
+}
+
+// newTestCoordinator serves the worker API for jobs that only remote
+// workers convert, retrying each once after a short wait.
+func newTestCoordinator(t *testing.T, ttl time.Duration) *testCoordinator {
+	t.Helper()
+	t.Setenv("TMPDIR", t.TempDir())
+	store := NewJobStore()
+	runner := NewRunner(store, nil, nil, newPool(0))
+	runner.retry = RetryPolicy{MaxAttempts: 2, Backoff: 10 * time.Millisecond}
+	coord := newCoordinator(runner, "secret", ttl)
+	srv := httptest.NewServer(WorkerHandler(coord))
+	t.Cleanup(srv.Close)
+	return &testCoordinator{Server: srv, coord: coord, store: store, runner: runner}
+}
+
+// enqueue queues a job that converts a file to MP3.
+func (c *testCoordinator) enqueue(t *testing.T) *Job {
+	t.Helper()
+	dir := t.TempDir()
+	input := filepath.Join(dir, "song.wav")
+	if err := os.WriteFile(input, []byte("input"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	rendition, err := pipeline.ParseRendition("mp3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := c.store.Create(JobSpec{
+		InPath:  input,
+		Outputs: []JobOutput{{Rendition: rendition, Path: filepath.Join(dir, "song.mp3")}},
+	})
+	opts := pipeline.DefaultOptions()
+	opts.Backend = &pipeline.FakeBackend{}
+	c.runner.Enqueue(job, opts)
+	return job
+}
+
+// startWorker runs a worker converting with backend until the test ends.
+func (c *testCoordinator) startWorker(t *testing.T, backend pipeline.Backend) {
+	t.Helper()
+	wk := &Worker{URL: c.URL, Token: "secret", Name: "test", Options: pipeline.Options{Backend: backend}}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		_ = wk.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-stopped
+	})
+}
+
+// call makes a worker API request and returns the response status and body.
+func (c *testCoordinator) call(t *testing.T, ctx context.Context, method, path, body string) (int, []byte) {
+	t.Helper()
+	req, err := http.NewRequestWithContext(ctx, method, c.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return 0, nil
+		}
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, b
+}
+
+// lease takes a lease without a worker to convert it.
+func (c *testCoordinator) lease(t *testing.T) assignment {
+	t.Helper()
+	status, body := c.call(t, context.Background(), http.MethodPost, "/api/worker/lease?worker=gone", "")
+	var a assignment
+	if status != http.StatusOK || json.Unmarshal(body, &a) != nil {
+		t.Fatalf("lease: %d %s", status, body)
+	}
+	return a
+}
+
+func (c *testCoordinator) attempts(id string) []JobAttempt {
+	return c.store.snapshot(id).Attempts
+}
+
+// slowBackend takes delay to convert.
+type slowBackend struct {
+	pipeline.FakeBackend
+	delay time.Duration
+}
+
+func (b *slowBackend) Convert(ctx context.Context, input string, outputs []pipeline.Output, opts pipeline.Options, stream io.Writer) error {
+	select {
+	case <-time.After(b.delay):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return b.FakeBackend.Convert(ctx, input, outputs, opts, stream)
+}
+
+func TestWorkerConvertsLeasedJob(t *testing.T) {
+	c := newTestCoordinator(t, time.Second)
+	c.startWorker(t, &pipeline.FakeBackend{Content: []byte("converted")})
+	job := c.enqueue(t)
+	if ev := waitJob(t, c.store, job.ID); ev.Status != JobDone {
+		t.Fatalf("job %s: %s", ev.Status, ev.Error)
+	}
+	if b, err := os.ReadFile(job.Outputs[0].Path); err != nil || string(b) != "converted" {
+		t.Errorf("output %q, %v", b, err)
+	}
+	if n := len(c.attempts(job.ID)); n != 0 {
+		t.Errorf("%d failed attempts, want none", n)
+	}
+}
+
+func TestHeartbeatsKeepLease(t *testing.T) {
+	ttl := 200 * time.Millisecond
+	c := newTestCoordinator(t, ttl)
+	c.startWorker(t, &slowBackend{delay: 4 * ttl})
+	job := c.enqueue(t)
+	if ev := waitJob(t, c.store, job.ID); ev.Status != JobDone {
+		t.Fatalf("job %s: %s", ev.Status, ev.Error)
+	}
+	if n := len(c.attempts(job.ID)); n != 0 {
+		t.Errorf("%d failed attempts, want none", n)
+	}
+}
+
+func TestLostWorkerIsRetried(t *testing.T) {
+	c := newTestCoordinator(t, 100*time.Millisecond)
+	job := c.enqueue(t)
+	a := c.lease(t)
+	// The lease expires without heartbeats, and the job goes back in the
+	// queue.
+	deadline := time.Now().Add(5 * time.Second)
+	for len(c.attempts(job.ID)) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("lease did not expire")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status, _ := c.call(t, context.Background(), http.MethodPost, "/api/worker/leases/"+a.Lease+"/heartbeat", "{}"); status != http.StatusGone {
+		t.Errorf("heartbeat on an expired lease: %d, want 410", status)
+	}
+
+	c.startWorker(t, &pipeline.FakeBackend{})
+	if ev := waitJob(t, c.store, job.ID); ev.Status != JobDone {
+		t.Fatalf("job %s: %s", ev.Status, ev.Error)
+	}
+	attempts := c.attempts(job.ID)
+	if len(attempts) != 1 || !attempts[0].Retried || attempts[0].ErrorCode != pipeline.CodeInternal {
+		t.Errorf("attempts %+v, want one retried internal failure", attempts)
+	}
+}
+
+func TestCompleteNeedsOutputs(t *testing.T) {
+	c := newTestCoordinator(t, time.Second)
+	job := c.enqueue(t)
+	a := c.lease(t)
+	if status, _ := c.call(t, context.Background(), http.MethodPost, "/api/worker/leases/"+a.Lease+"/complete", "{}"); status != http.StatusConflict {
+		t.Errorf("complete without outputs: %d, want 409", status)
+	}
+	c.startWorker(t, &pipeline.FakeBackend{})
+	if ev := waitJob(t, c.store, job.ID); ev.Status != JobDone {
+		t.Fatalf("job %s: %s", ev.Status, ev.Error)
+	}
+	if n := len(c.attempts(job.ID)); n != 1 {
+		t.Errorf("%d failed attempts, want 1", n)
+	}
+}
+
+func TestUnclaimedJobWaitsForWorker(t *testing.T) {
+	c := newTestCoordinator(t, 100*time.Millisecond)
+	// A worker asks for a lease and gives up before a job comes.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if status, _ := c.call(t, ctx, http.MethodPost, "/api/worker/lease?worker=gone", ""); status != 0 {
+		t.Fatalf("lease: %d, want none", status)
+	}
+	// Give the coordinator time to notice the worker hung up.
+	time.Sleep(100 * time.Millisecond)
+	job := c.enqueue(t)
+	time.Sleep(300 * time.Millisecond)
+	if ev, _ := c.store.Event(job.ID); ev.Status != JobPending {
+		t.Fatalf("job %s without a worker, want pending", ev.Status)
+	}
+
+	c.startWorker(t, &pipeline.FakeBackend{})
+	if ev := waitJob(t, c.store, job.ID); ev.Status != JobDone {
+		t.Fatalf("job %s: %s", ev.Status, ev.Error)
+	}
+	if n := len(c.attempts(job.ID)); n != 0 {
+		t.Errorf("%d failed attempts, want none", n)
+	}
+}
+
+func TestJobReturnsToQueueWhenWorkerLeaves(t *testing.T) {
+	c := newTestCoordinator(t, time.Second)
+	job := c.enqueue(t)
+	task, ok := c.runner.pool.Take(context.Background())
+	if !ok {
+		t.Fatal("no task queued")
+	}
+	// The worker the job was taken for is gone by the time it is leased.
+	gone, cancel := context.WithCancel(context.Background())
+	cancel()
+	c.coord.run(task.Job, task.Opts, func(job *Job, opts pipeline.Options) error {
+		return c.coord.dispatch(gone, "gone", job, opts, make(chan *lease))
+	})
+	if ev, _ := c.store.Event(job.ID); ev.Status != JobPending {
+		t.Fatalf("job %s, want pending", ev.Status)
+	}
+
+	c.startWorker(t, &pipeline.FakeBackend{})
+	if ev := waitJob(t, c.store, job.ID); ev.Status != JobDone {
+		t.Fatalf("job %s: %s", ev.Status, ev.Error)
+	}
+	if n := len(c.attempts(job.ID)); n != 0 {
+		t.Errorf("%d failed attempts, want none", n)
+	}
+}
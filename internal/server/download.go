@@ -0,0 +1,236 @@
+package server
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const zipDownloadName = "all.zip"
+
+// DownloadHandler serves /convert/download/{id} (the first rendition),
+// /convert/download/{id}/{rendition} and /convert/download/{id}/all.zip.
+// Split jobs are always served as a zip of their tracks, of every rendition
+// or of the one named. Callers need the job owner's credentials or a signed
+// link for the job.
+func DownloadHandler(store *JobStore, links *linkSigner) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		id, name, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/convert/download/"), "/")
+		var single bool
+		var sig string
+		if r.URL.Query().Has("sig") {
+			var err error
+			if single, sig, err = links.Verify(id, r.URL.Query(), time.Now()); err != nil {
+				writeError(w, http.StatusForbidden, err.Error())
+				return
+			}
+		} else {
+			owner, ok := jobOwner(w, r)
+			if !ok {
+				return
+			}
+			if !store.Owns(id, owner) {
+				writeError(w, http.StatusNotFound, "job not found")
+				return
+			}
+		}
+		job := store.snapshot(id)
+		ev, ok := store.Event(id)
+		if job == nil || !ok {
+			writeError(w, http.StatusNotFound, "job not found")
+			return
+		}
+		if ev.Status != JobDone {
+			writeError(w, http.StatusConflict, "job not ready")
+			return
+		}
+
+		var out JobOutput
+		asZip := name == zipDownloadName || job.Tracks != nil
+		if name == zipDownloadName {
+			name = ""
+		}
+		if name != "" || !asZip {
+			if out, ok = job.output(name); !ok {
+				writeError(w, http.StatusNotFound, "rendition not found")
+				return
+			}
+		}
+
+		if single && r.Method == http.MethodGet && !store.ClaimLink(id, sig) {
+			writeError(w, http.StatusGone, "download link already used")
+			return
+		}
+
+		rw := &statusRecorder{ResponseWriter: w}
+		complete := true
+		if asZip {
+			complete = serveZip(rw, r, job, name)
+		} else {
+			serveOutput(rw, r, job, out)
+		}
+		if r.Method == http.MethodGet && complete && rw.delivered() {
+			store.RecordDownload(id)
+		}
+	}
+}
+
+func serveOutput(w http.ResponseWriter, r *http.Request, job *Job, out JobOutput) {
+	f, err := os.Open(out.Path)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "job not found")
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to read output")
+		return
+	}
+
+	w.Header().Set("Content-Type", out.Rendition.MIMEType())
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", out.Filename))
+	w.Header().Set("ETag", fmt.Sprintf(`"%s-%s"`, job.ID, out.Rendition.Name))
+	w.Header().Set("Cache-Control", "private, no-transform")
+	http.ServeContent(w, r, "", fi.ModTime(), f)
+}
+
+// serveZip streams the outputs of one rendition, or of all when rendition is
+// empty, as an uncompressed zip; the audio is already compressed, so
+// deflating it would only cost CPU. It reports whether the whole archive
+// was written.
+func serveZip(w http.ResponseWriter, r *http.Request, job *Job, rendition string) bool {
+	name := strings.TrimSuffix(job.InputName, filepath.Ext(job.InputName)) + "_modified"
+	if rendition != "" {
+		name += "_" + rendition
+	}
+	name += ".zip"
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	w.Header().Set("Cache-Control", "private, no-transform")
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return true
+	}
+	var entries []zipEntry
+	for _, o := range job.Outputs {
+		if rendition != "" && o.Rendition.Name != rendition {
+			continue
+		}
+		name := o.Filename
+		if rendition != "" && job.Tracks != nil {
+			name = path.Base(name)
+		}
+		entries = append(entries, zipEntry{path: o.Path, name: name})
+	}
+	return writeZip(w, job.ID, entries)
+}
+
+type zipEntry struct {
+	path string
+	name string
+}
+
+// writeZip streams files into a zip archive. Headers are already sent, so
+// a failure can only be logged and the archive left truncated; writeZip
+// reports whether there was none.
+func writeZip(w io.Writer, id string, entries []zipEntry) bool {
+	zw := zip.NewWriter(w)
+	for _, e := range entries {
+		if err := addZipFile(zw, e.path, e.name); err != nil {
+			log.Printf("%s: zip %s: %v", id, e.name, err)
+			return false
+		}
+	}
+	if err := zw.Close(); err != nil {
+		log.Printf("%s: zip: %v", id, err)
+		return false
+	}
+	return true
+}
+
+func addZipFile(zw *zip.Writer, path, name string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr, err := zip.FileInfoHeader(fi)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	hdr.Method = zip.Store
+	dst, err := zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, f)
+	return err
+}
+
+// statusRecorder captures the status code written by a wrapped handler and
+// how much of the body got through.
+type statusRecorder struct {
+	http.ResponseWriter
+	status  int
+	written int64
+	err     error
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.written += int64(n)
+	if err != nil && r.err == nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// delivered reports whether the client got the file to its end: the whole
+// of it, or a range that runs to the end, so that a download resumed or
+// fetched in pieces counts once.
+func (r *statusRecorder) delivered() bool {
+	if r.err != nil {
+		return false
+	}
+	switch r.status {
+	case http.StatusOK:
+		n, err := strconv.ParseInt(r.Header().Get("Content-Length"), 10, 64)
+		return err != nil || r.written == n
+	case http.StatusPartialContent:
+		var first, last, size int64
+		if _, err := fmt.Sscanf(r.Header().Get("Content-Range"), "bytes %d-%d/%d", &first, &last, &size); err != nil {
+			return false
+		}
+		return last == size-1 && r.written == last-first+1
+	}
+	return false
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"copyrem/pipeline"
+)
+
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		log.Printf("invalid %s %q, using %s", name, v, def)
+		return def
+	}
+	return d
+}
+
+func envInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		log.Printf("invalid %s %q, using %d", name, v, def)
+		return def
+	}
+	return n
+}
+
+// envBackend reads BACKEND, the name of the pipeline backend conversions
+// use. The fake backend is for tests only, even when one registers it.
+func envBackend() pipeline.Backend {
+	v := os.Getenv("BACKEND")
+	b, err := pipeline.LookupBackend(v)
+	if _, fake := b.(*pipeline.FakeBackend); err != nil || fake {
+		log.Printf("invalid BACKEND %q, using ffmpeg", v)
+		return pipeline.FFmpeg
+	}
+	return b
+}
+
+// envLimits reads the limits on conversions and the ffmpeg processes they
+// run. Each job gets a working directory under WORK_DIR.
+func envLimits() pipeline.Limits {
+	const mb = 1 << 20
+	l := pipeline.Limits{
+		Timeout:          envDuration("PROCESS_TIMEOUT", 2*time.Minute),
+		TimeoutPerMinute: envDuration("PROCESS_TIMEOUT_PER_MINUTE", 2*time.Minute),
+		Memory:           int64(envInt("PROCESS_MAX_MEMORY_MB", 2048)) * mb,
+		FileSize:         int64(envInt("PROCESS_MAX_FILE_MB", 2048)) * mb,
+		CPU:              envDuration("PROCESS_MAX_CPU", 0),
+		Nice:             envInt("PROCESS_NICE", 0),
+		Dir:              os.Getenv("WORK_DIR"),
+	}
+	if l.Dir == "" {
+		l.Dir = filepath.Join(os.TempDir(), "copyrem-work")
+	}
+	if err := os.MkdirAll(l.Dir, 0o700); err != nil {
+		log.Printf("work dir: %v", err)
+		l.Dir = ""
+	}
+	return l
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"slices"
+	"strings"
+	"time"
+
+	"copyrem/pipeline"
+)
+
+const defaultHistoryRetention = 24 * time.Hour
+
+// JobRecord describes a job for listings. Records of removed jobs are kept
+// in the store's history, without their files, for historyRetention.
+type JobRecord struct {
+	ID           string            `json:"id"`
+	Owner        string            `json:"owner"`
+	Status       JobStatus         `json:"status"`
+	BatchID      string            `json:"batch_id,omitempty"`
+	InputName    string            `json:"input_name"`
+	InputBytes   int64             `json:"input_bytes"`
+	InputSeconds float64           `json:"input_seconds,omitempty"`
+	InputSHA256  string            `json:"input_sha256"`
+	Intensity    float64           `json:"intensity"`
+	Params       pipeline.Params   `json:"params"`
+	Segment      *pipeline.Segment `json:"segment,omitempty"`
+	Priority     Priority          `json:"priority"`
+	CreatedAt    time.Time         `json:"created_at"`
+	StartedAt    *time.Time        `json:"started_at,omitempty"`
+	FinishedAt   *time.Time        `json:"finished_at,omitempty"`
+	QueueSeconds float64           `json:"queue_seconds,omitempty"`
+	RunSeconds   float64           `json:"run_seconds,omitempty"`
+	OutputBytes  int64             `json:"output_bytes,omitempty"`
+	Tracks       []TrackRecord     `json:"tracks,omitempty"`
+	Quality      *QualityReport    `json:"quality,omitempty"`
+	Outputs      []OutputRecord    `json:"outputs"`
+	Cached       bool              `json:"cached"`
+	Downloads    int               `json:"downloads"`
+	Error        string            `json:"error,omitempty"`
+	ErrorCode    pipeline.Code     `json:"error_code,omitempty"`
+	Available    bool              `json:"available"`
+	// Attempts lists the failed runs of the job. StartedAt is the start
+	// of the latest one.
+	Attempts []JobAttempt `json:"attempts,omitempty"`
+}
+
+// record summarizes a job. Callers must hold s.mu.
+func (j *Job) record(now time.Time, available bool) JobRecord {
+	rec := JobRecord{
+		ID:           j.ID,
+		Owner:        j.Owner,
+		Status:       j.Status,
+		BatchID:      j.BatchID,
+		InputName:    j.InputName,
+		InputBytes:   j.InputBytes,
+		InputSeconds: roundSeconds(j.duration),
+		InputSHA256:  j.InputSHA256,
+		Intensity:    j.Intensity,
+		Params:       j.Params,
+		Priority:     j.Priority,
+		CreatedAt:    j.CreatedAt,
+		OutputBytes:  j.Progress.OutputSize,
+		Cached:       j.Cached,
+		Downloads:    j.Downloads,
+		Error:        j.Error,
+		ErrorCode:    j.ErrorCode,
+		Tracks:       trackRecords(j.Tracks),
+		Quality:      j.QualityReport,
+		Available:    available,
+		Attempts:     slices.Clone(j.Attempts),
+	}
+	if !j.Segment.IsZero() {
+		seg := j.Segment
+		rec.Segment = &seg
+	}
+	if !j.StartedAt.IsZero() {
+		started := j.StartedAt
+		rec.StartedAt = &started
+		rec.QueueSeconds = roundSeconds(started.Sub(j.CreatedAt))
+		end := now
+		if !j.FinishedAt.IsZero() {
+			end = j.FinishedAt
+		}
+		rec.RunSeconds = roundSeconds(end.Sub(started))
+	}
+	if !j.FinishedAt.IsZero() {
+		finished := j.FinishedAt
+		rec.FinishedAt = &finished
+	}
+	for _, o := range j.Outputs {
+		rec.Outputs = append(rec.Outputs, OutputRecord{
+			Name:    o.Rendition.Name,
+			Format:  o.Rendition.Format,
+			Bitrate: o.Rendition.Bitrate,
+			Track:   o.Track,
+			Bytes:   o.Size,
+		})
+	}
+	return rec
+}
+
+type OutputRecord struct {
+	Name    string `json:"name"`
+	Format  string `json:"format"`
+	Bitrate string `json:"bitrate,omitempty"`
+	Track   int    `json:"track,omitempty"`
+	Bytes   int64  `json:"bytes"`
+}
+
+type JobFilter struct {
+	Owner    string
+	Statuses []JobStatus
+	Since    time.Time
+	Until    time.Time
+}
+
+func (f JobFilter) match(r JobRecord) bool {
+	if f.Owner != "" && r.Owner != f.Owner {
+		return false
+	}
+	if len(f.Statuses) > 0 && !slices.Contains(f.Statuses, r.Status) {
+		return false
+	}
+	if !f.Since.IsZero() && r.CreatedAt.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !r.CreatedAt.Before(f.Until) {
+		return false
+	}
+	return true
+}
+
+// List returns live and historical jobs matching f, newest first.
+func (s *JobStore) List(f JobFilter) []JobRecord {
+	now := time.Now()
+	s.mu.RLock()
+	var out []JobRecord
+	for _, j := range s.jobs {
+		if rec := j.record(now, j.Status == JobDone); f.match(rec) {
+			out = append(out, rec)
+		}
+	}
+	for _, rec := range s.history {
+		if f.match(rec) {
+			out = append(out, rec)
+		}
+	}
+	s.mu.RUnlock()
+	slices.SortFunc(out, func(a, b JobRecord) int {
+		if c := b.CreatedAt.Compare(a.CreatedAt); c != 0 {
+			return c
+		}
+		return strings.Compare(b.ID, a.ID)
+	})
+	return out
+}
+
+// Record returns a single live or historical job.
+func (s *JobStore) Record(id string) (JobRecord, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if j := s.jobs[id]; j != nil {
+		return j.record(time.Now(), j.Status == JobDone), true
+	}
+	for _, rec := range s.history {
+		if rec.ID == id {
+			return rec, true
+		}
+	}
+	return JobRecord{}, false
+}
+
+// pruneHistory drops records of jobs that finished, or were created if they
+// never did, more than historyRetention ago. Callers must hold s.mu.
+func (s *JobStore) pruneHistory(now time.Time) {
+	cutoff := now.Add(-s.historyRetention)
+	s.history = slices.DeleteFunc(s.history, func(rec JobRecord) bool {
+		at := rec.CreatedAt
+		if rec.FinishedAt != nil {
+			at = *rec.FinishedAt
+		}
+		return at.Before(cutoff)
+	})
+}
@@ -3,19 +3,22 @@ package server
 import (
 	"encoding/json"
 	"net/http"
-)
 
-var infoJSON []byte
+	"copyrem/pipeline"
+)
 
-func init() {
-	infoJSON, _ = json.Marshal(struct {
+// InfoHandler describes the upload limits and what backend can write.
+func InfoHandler(backend pipeline.Backend) http.HandlerFunc {
+	caps := backend.Capabilities()
+	infoJSON, _ := json.Marshal(struct {
 		MaxUploadMB       int      `json:"max_upload_mb"`
 		AllowedExtensions []string `json:"allowed_extensions"`
+		VideoExtensions   []string `json:"video_extensions"`
 		DownloadSuffix    string   `json:"download_suffix"`
-	}{MaxUploadMB, AllowedExtensions, DownloadSuffix})
-}
-
-func InfoHandler() http.HandlerFunc {
+		RenditionFormats  []string `json:"rendition_formats"`
+		MaxRenditions     int      `json:"max_renditions"`
+		Backend           string   `json:"backend"`
+	}{MaxUploadMB, AllowedExtensions, VideoExtensions, DownloadSuffix, caps.Formats, MaxRenditions, backend.Name()})
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
 			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
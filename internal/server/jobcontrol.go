@@ -0,0 +1,191 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+var (
+	errJobNotFound   = errors.New("job not found")
+	errJobNotRunning = errors.New("job is not running")
+	errJobNotPaused  = errors.New("job is not paused")
+
+	errInvalidMessage = errors.New("invalid message")
+	errUnknownAction  = errors.New("unknown action")
+)
+
+type Priority int
+
+const (
+	PriorityLow    Priority = -1
+	PriorityNormal Priority = 0
+	PriorityHigh   Priority = 1
+)
+
+func ParsePriority(s string) (Priority, error) {
+	switch s {
+	case "low":
+		return PriorityLow, nil
+	case "", "normal":
+		return PriorityNormal, nil
+	case "high":
+		return PriorityHigh, nil
+	}
+	return 0, fmt.Errorf("unknown priority %q", s)
+}
+
+func (p Priority) String() string {
+	switch {
+	case p < PriorityNormal:
+		return "low"
+	case p > PriorityNormal:
+		return "high"
+	}
+	return "normal"
+}
+
+func (p Priority) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+func (p *Priority) UnmarshalText(b []byte) error {
+	v, err := ParsePriority(string(b))
+	if err != nil {
+		return err
+	}
+	*p = v
+	return nil
+}
+
+// nice maps a priority to the niceness of the job's ffmpeg process. Raising
+// priority above normal needs privileges the server usually does not have.
+func (p Priority) nice() int {
+	switch p {
+	case PriorityLow:
+		return 10
+	case PriorityHigh:
+		return -5
+	}
+	return 0
+}
+
+// priority returns a job's current priority.
+func (s *JobStore) priority(id string) Priority {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if j := s.jobs[id]; j != nil {
+		return j.Priority
+	}
+	return PriorityNormal
+}
+
+// paused returns how long the current attempt at a job has been paused.
+func (s *JobStore) paused(id string) time.Duration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if j := s.jobs[id]; j != nil {
+		return j.paused(time.Now())
+	}
+	return 0
+}
+
+// paused returns how long the job's current attempt has been paused by now.
+// Callers must hold the store lock.
+func (j *Job) paused(now time.Time) time.Duration {
+	if j.Status == JobPaused {
+		return j.pausedFor + now.Sub(j.pausedAt)
+	}
+	return j.pausedFor
+}
+
+// SetProcess records the running process of a job, which started at the
+// niceness base, and applies the job's priority on top of it.
+func (s *JobStore) SetProcess(id string, p *os.Process, base int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j := s.jobs[id]
+	if j == nil {
+		return
+	}
+	j.proc, j.baseNice = p, base
+	if n := j.Priority.nice(); n != 0 {
+		_ = setProcessNice(p, base+n)
+	}
+}
+
+// ClearProcess forgets the process of a job once it has exited, so that
+// nothing signals its PID afterwards. A job paused meanwhile, which only
+// happens when its process is killed, runs on.
+func (s *JobStore) ClearProcess(id string, p *os.Process) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j := s.jobs[id]
+	if j == nil || j.proc != p {
+		return
+	}
+	j.proc = nil
+	if j.Status == JobPaused {
+		j.Status = JobRunning
+		j.pausedFor += time.Since(j.pausedAt)
+		j.pausedAt = time.Time{}
+		s.publish(j)
+	}
+}
+
+func (s *JobStore) Pause(id string) error {
+	return s.control(id, func(j *Job) error {
+		if j.Status != JobRunning || j.proc == nil {
+			return errJobNotRunning
+		}
+		if err := suspendProcess(j.proc); err != nil {
+			return err
+		}
+		j.Status = JobPaused
+		j.pausedAt = time.Now()
+		return nil
+	})
+}
+
+func (s *JobStore) Resume(id string) error {
+	return s.control(id, func(j *Job) error {
+		if j.Status != JobPaused || j.proc == nil {
+			return errJobNotPaused
+		}
+		if err := resumeProcess(j.proc); err != nil {
+			return err
+		}
+		j.Status = JobRunning
+		j.pausedFor += time.Since(j.pausedAt)
+		j.pausedAt = time.Time{}
+		return nil
+	})
+}
+
+func (s *JobStore) SetPriority(id string, p Priority) error {
+	return s.control(id, func(j *Job) error {
+		if j.proc != nil && (j.Status == JobRunning || j.Status == JobPaused) {
+			if err := setProcessNice(j.proc, j.baseNice+p.nice()); err != nil {
+				return fmt.Errorf("set priority: %w", err)
+			}
+		}
+		j.Priority = p
+		return nil
+	})
+}
+
+// control applies fn to a job and publishes the change if fn succeeds.
+func (s *JobStore) control(id string, fn func(*Job) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j := s.jobs[id]
+	if j == nil {
+		return errJobNotFound
+	}
+	if err := fn(j); err != nil {
+		return err
+	}
+	s.publish(j)
+	return nil
+}
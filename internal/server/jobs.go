@@ -4,58 +4,229 @@ import (
 	"context"
 	"crypto/rand"
 	"fmt"
+	"log"
+	"math"
 	"os"
+	"slices"
 	"sync"
 	"time"
+
+	"copyrem/pipeline"
 )
 
 type JobStatus string
 
 const (
-	JobPending   JobStatus = "pending"
-	JobRunning   JobStatus = "running"
-	JobDone      JobStatus = "done"
-	JobFailed JobStatus = "failed"
+	JobPending JobStatus = "pending"
+	JobRunning JobStatus = "running"
+	JobPaused  JobStatus = "paused"
+	JobDone    JobStatus = "done"
+	JobFailed  JobStatus = "failed"
+	// JobCancelled only appears in history, for jobs removed before finishing.
+	JobCancelled JobStatus = "cancelled"
 
+	// jobTTL is how long a running job lasts without a sign of life from
+	// the goroutine running it.
 	jobTTL          = 5 * time.Minute
+	jobQueueTTL     = time.Hour
 	jobCleanupEvery = 30 * time.Second
+
+	defaultAbandonTimeout = 2 * time.Minute
+	defaultRetention      = 15 * time.Minute
 )
 
 type Job struct {
-	ID           string
-	Status       JobStatus
-	Percent      int
-	InPath       string
-	OutPath      string
-	OriginalName string
+	ID          string
+	Owner       string
+	Status      JobStatus
+	Percent     int
+	InPath      string
+	Outputs     []JobOutput
+	BatchID     string
+	RelDir      string
+	InputName   string
+	InputBytes  int64
+	InputSHA256 string
+	Params      pipeline.Params
+	Intensity   float64
+	Segment     pipeline.Segment
+	Split       *Split
+	// Tracks is the track layout of a split job, once known.
+	Tracks *pipeline.TrackList
+	// Analyze keeps the input until the job is removed and precomputes its
+	// waveforms and spectrograms.
+	Analyze      bool
+	artifacts    map[string]string
+	Cached       bool
 	Error        string
+	ErrorCode    pipeline.Code
 	CreatedAt    time.Time
+	StartedAt    time.Time
+	FinishedAt   time.Time
+	Downloads    int
+	MaxDownloads int
+	usedLinks    map[string]bool
+	Priority     Priority
 	Ctx          context.Context
 	cancel       context.CancelFunc
+	Progress     pipeline.Progress
+	proc         *os.Process
+	baseNice     int
+	seq          uint64
+	watchers     map[chan struct{}]struct{}
+	// unwatchedAt is when the last listener left; zero if none ever came.
+	unwatchedAt time.Time
+	// Quality asks for QualityReport to be filled in once the job is
+	// converted.
+	Quality       bool
+	QualityReport *QualityReport
+	// Attempts records the failed runs of the job, oldest first.
+	Attempts []JobAttempt
+	opts     pipeline.Options
+	cost     time.Duration
+	tries    int
+	queuedAt time.Time
+	// pausedAt is when the job was last paused; pausedFor sums the pauses
+	// of its current attempt before that.
+	pausedAt  time.Time
+	pausedFor time.Duration
+	// Client is who the scheduler queues the job for: the API key, or the
+	// address of an anonymous uploader.
+	Client string
+	// aliveAt is when the goroutine running the job last reported in.
+	aliveAt time.Time
+	// duration is the length of the input, as probed when the job was
+	// queued; zero if that failed.
+	duration time.Duration
+}
+
+// JobEvent is a snapshot of a job's state. ID increases with every change,
+// so it doubles as the SSE event ID for resuming a stream.
+type JobEvent struct {
+	ID               uint64        `json:"-"`
+	Status           JobStatus     `json:"status"`
+	Stage            string        `json:"stage,omitempty"`
+	Percent          int           `json:"percent"`
+	ProcessedSeconds float64       `json:"processed_seconds,omitempty"`
+	TotalSeconds     float64       `json:"total_seconds,omitempty"`
+	Speed            float64       `json:"speed,omitempty"`
+	ETASeconds       float64       `json:"eta_seconds,omitempty"`
+	OutputBytes      int64         `json:"output_bytes,omitempty"`
+	Outputs          []OutputEvent `json:"outputs,omitempty"`
+	Priority         Priority      `json:"priority"`
+	Cached           bool          `json:"cached,omitempty"`
+	Done             bool          `json:"done,omitempty"`
+	Error            string        `json:"error,omitempty"`
+	ErrorCode        pipeline.Code `json:"error_code,omitempty"`
+	// Attempt numbers the runs of jobs that have failed before.
+	Attempt int `json:"attempt,omitempty"`
+}
+
+func (e JobEvent) Type() string {
+	switch e.Status {
+	case JobPending:
+		return "queued"
+	case JobPaused:
+		return "paused"
+	case JobDone:
+		return "done"
+	case JobFailed:
+		return "failed"
+	default:
+		return "progress"
+	}
+}
+
+func (e JobEvent) Terminal() bool {
+	return e.Status == JobDone || e.Status == JobFailed
 }
 
 type JobStore struct {
 	mu   sync.RWMutex
 	jobs map[string]*Job
+	// abandonAfter cancels unfinished jobs that have had no progress
+	// listeners for this long. Zero disables abandonment.
+	abandonAfter time.Duration
+	// retention is how long finished jobs and their outputs are kept.
+	retention time.Duration
+	// maxDownloads removes a job after that many downloads. Zero means
+	// downloads are limited only by retention.
+	maxDownloads int
+	// history keeps records of removed jobs for historyRetention.
+	history          []JobRecord
+	historyRetention time.Duration
+	batches          map[string]*Batch
 }
 
 func NewJobStore() *JobStore {
-	s := &JobStore{jobs: make(map[string]*Job)}
+	s := &JobStore{
+		jobs:         make(map[string]*Job),
+		batches:      make(map[string]*Batch),
+		abandonAfter: envDuration("JOB_ABANDON_TIMEOUT", defaultAbandonTimeout),
+		retention:    envDuration("DOWNLOAD_RETENTION", defaultRetention),
+		maxDownloads: envInt("DOWNLOAD_MAX_COUNT", 0),
+
+		historyRetention: envDuration("JOB_HISTORY_RETENTION", defaultHistoryRetention),
+	}
 	go s.cleanup()
 	return s
 }
 
-func (s *JobStore) Create(inPath, outPath, originalName string) *Job {
+type JobSpec struct {
+	Owner       string
+	InPath      string
+	Outputs     []JobOutput
+	RelDir      string
+	InputName   string
+	InputBytes  int64
+	InputSHA256 string
+	Params      pipeline.Params
+	Intensity   float64
+	Segment     pipeline.Segment
+	Split       *Split
+	Analyze     bool
+	Quality     bool
+	// MaxDownloads lowers the store's download limit for this job.
+	MaxDownloads int
+	Priority     Priority
+	Client       string
+}
+
+func (s *JobStore) Create(spec JobSpec) *Job {
 	ctx, cancel := context.WithCancel(context.Background())
+	now := time.Now()
+	maxDownloads := s.maxDownloads
+	if spec.MaxDownloads > 0 && (maxDownloads == 0 || spec.MaxDownloads < maxDownloads) {
+		maxDownloads = spec.MaxDownloads
+	}
 	j := &Job{
 		ID:           randHex(8),
+		Owner:        spec.Owner,
 		Status:       JobPending,
-		InPath:       inPath,
-		OutPath:      outPath,
-		OriginalName: originalName,
-		CreatedAt:    time.Now(),
+		InPath:       spec.InPath,
+		Outputs:      spec.Outputs,
+		RelDir:       spec.RelDir,
+		InputName:    spec.InputName,
+		InputBytes:   spec.InputBytes,
+		InputSHA256:  spec.InputSHA256,
+		Params:       spec.Params,
+		Intensity:    spec.Intensity,
+		Segment:      spec.Segment,
+		Split:        spec.Split,
+		Analyze:      spec.Analyze,
+		Quality:      spec.Quality,
+		MaxDownloads: maxDownloads,
+		Priority:     spec.Priority,
+		Client:       spec.Client,
+		CreatedAt:    now,
 		Ctx:          ctx,
 		cancel:       cancel,
+		seq:          1,
+		watchers:     make(map[chan struct{}]struct{}),
+		queuedAt:     now,
+	}
+	if spec.Split != nil {
+		j.Tracks = spec.Split.List
 	}
 	s.mu.Lock()
 	s.jobs[j.ID] = j
@@ -69,38 +240,208 @@ func (s *JobStore) Get(id string) *Job {
 	return s.jobs[id]
 }
 
+// snapshot returns a copy of a job whose outputs and tracks, which change
+// while it runs, can be read without the lock; nil if the job is gone.
+func (s *JobStore) snapshot(id string) *Job {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	j := s.jobs[id]
+	if j == nil {
+		return nil
+	}
+	cp := *j
+	cp.Outputs = slices.Clone(j.Outputs)
+	return &cp
+}
+
+// Owns reports whether the job exists and belongs to owner. Handlers treat
+// a job owned by someone else as not found.
+func (s *JobStore) Owns(id, owner string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	j := s.jobs[id]
+	return j != nil && owner != "" && j.Owner == owner
+}
+
 func (s *JobStore) SetRunning(id string) {
-	s.mu.Lock()
-	if j := s.jobs[id]; j != nil {
+	s.update(id, func(j *Job) {
 		j.Status = JobRunning
-	}
-	s.mu.Unlock()
+		j.tries++
+		j.aliveAt = time.Now()
+		if j.StartedAt.IsZero() {
+			j.StartedAt = j.aliveAt
+		}
+	})
 }
 
-func (s *JobStore) SetPercent(id string, pct int) {
-	s.mu.Lock()
-	if j := s.jobs[id]; j != nil {
-		j.Percent = pct
-	}
-	s.mu.Unlock()
+// keepAlive reports that the job is still being worked on until the
+// returned func is called, so that it doesn't expire however long its steps
+// take; each of them is bounded by a timeout of its own.
+func (s *JobStore) keepAlive(id string) func() {
+	done := make(chan struct{})
+	go func() {
+		tick := time.NewTicker(jobTTL / 4)
+		defer tick.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-tick.C:
+				s.mu.Lock()
+				if j := s.jobs[id]; j != nil {
+					j.aliveAt = now
+				}
+				s.mu.Unlock()
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+func (s *JobStore) SetProgress(id string, p pipeline.Progress) {
+	sizes := s.outputSizes(id)
+	s.update(id, func(j *Job) {
+		j.Progress = p
+		j.Percent = p.Percent
+		j.setSizes(sizes)
+	})
 }
 
 func (s *JobStore) SetDone(id string) {
-	s.mu.Lock()
-	if j := s.jobs[id]; j != nil {
+	sizes := s.outputSizes(id)
+	s.update(id, func(j *Job) {
 		j.Status = JobDone
 		j.Percent = 100
+		j.FinishedAt = time.Now()
+		j.setSizes(sizes)
+	})
+}
+
+// SetCached finishes a job whose output was taken from the result cache.
+func (s *JobStore) SetCached(id string) {
+	sizes := s.outputSizes(id)
+	s.update(id, func(j *Job) {
+		j.Status = JobDone
+		j.Percent = 100
+		j.Cached = true
+		j.FinishedAt = time.Now()
+		j.Progress = pipeline.Progress{Stage: pipeline.StageEncoding, Percent: 100, Done: true}
+		j.setSizes(sizes)
+		j.Progress.OutputSize = j.outputBytes()
+	})
+}
+
+// SetAnalyzing marks a converted job as computing its waveforms and
+// spectrograms.
+func (s *JobStore) SetAnalyzing(id string) {
+	s.update(id, func(j *Job) {
+		j.Progress.Stage = pipeline.StageAnalyzing
+		j.Progress.Done = false
+		j.Percent = 99
+		j.Progress.Percent = 99
+	})
+}
+
+func (s *JobStore) setOutputKeys(id string, keys []string) {
+	s.update(id, func(j *Job) {
+		for i := range keys {
+			j.Outputs[i].CacheKey = keys[i]
+		}
+	})
+}
+
+// SetFailed marks a job failed, with a message users may see.
+func (s *JobStore) SetFailed(id string, code pipeline.Code, errMsg string) {
+	s.update(id, func(j *Job) {
+		j.Status = JobFailed
+		j.Error, j.ErrorCode = errMsg, code
+		j.addAttempt(code, errMsg, false)
+		j.FinishedAt = time.Now()
+	})
+}
+
+func (s *JobStore) update(id string, fn func(*Job)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j := s.jobs[id]
+	if j == nil {
+		return
 	}
-	s.mu.Unlock()
+	fn(j)
+	s.publish(j)
 }
 
-func (s *JobStore) SetFailed(id string, errMsg string) {
+// publish records a state change and wakes subscribers. Callers must hold s.mu.
+func (s *JobStore) publish(j *Job) {
+	j.seq++
+	for ch := range j.watchers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Subscribe returns a channel that receives a signal whenever the job changes
+// and is closed when the job is removed. Changes are coalesced, so receivers
+// should read the current state with Event after each signal.
+func (s *JobStore) Subscribe(id string) (<-chan struct{}, func(), bool) {
 	s.mu.Lock()
-	if j := s.jobs[id]; j != nil {
-		j.Status = JobFailed
-		j.Error = errMsg
+	defer s.mu.Unlock()
+	j := s.jobs[id]
+	if j == nil {
+		return nil, nil, false
 	}
-	s.mu.Unlock()
+	ch := make(chan struct{}, 1)
+	j.watchers[ch] = struct{}{}
+	unsubscribe := func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if _, ok := j.watchers[ch]; ok {
+			delete(j.watchers, ch)
+			close(ch)
+			if len(j.watchers) == 0 {
+				j.unwatchedAt = time.Now()
+			}
+		}
+	}
+	return ch, unsubscribe, true
+}
+
+func (s *JobStore) Event(id string) (JobEvent, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	j := s.jobs[id]
+	if j == nil {
+		return JobEvent{}, false
+	}
+	ev := JobEvent{
+		ID:               j.seq,
+		Status:           j.Status,
+		Stage:            j.Progress.Stage,
+		Percent:          j.Percent,
+		ProcessedSeconds: roundSeconds(j.Progress.Processed),
+		TotalSeconds:     roundSeconds(j.Progress.Total),
+		Speed:            j.Progress.Speed,
+		OutputBytes:      j.Progress.OutputSize,
+		Outputs:          j.outputEvents(),
+		Priority:         j.Priority,
+		Cached:           j.Cached,
+		Done:             j.Status == JobDone,
+		Error:            j.Error,
+		ErrorCode:        j.ErrorCode,
+	}
+	if len(j.Attempts) > 0 {
+		ev.Attempt = j.attempt()
+	}
+	if j.Status == JobRunning {
+		ev.ETASeconds = roundSeconds(j.Progress.ETA)
+	}
+	return ev, true
+}
+
+func roundSeconds(d time.Duration) float64 {
+	return math.Round(d.Seconds()*10) / 10
 }
 
 func (s *JobStore) Cancel(id string) {
@@ -111,32 +452,35 @@ func (s *JobStore) Cancel(id string) {
 		return
 	}
 	j.cancel()
-	in, out := j.InPath, j.OutPath
-	delete(s.jobs, id)
+	files := j.files()
+	s.remove(id)
 	s.mu.Unlock()
-	_ = os.Remove(in)
-	_ = os.Remove(out)
+	for _, p := range files {
+		_ = os.Remove(p)
+	}
 }
 
 func (s *JobStore) cleanup() {
 	for {
 		time.Sleep(jobCleanupEvery)
 		now := time.Now()
-		
+
 		var toDelete []string
 		var pathsToDelete []string
 
 		s.mu.Lock()
 		for id, j := range s.jobs {
-			if now.Sub(j.CreatedAt) > jobTTL {
+			if s.expired(j, now) || s.abandoned(j, now) {
 				j.cancel()
-				pathsToDelete = append(pathsToDelete, j.InPath, j.OutPath)
+				pathsToDelete = append(pathsToDelete, j.files()...)
 				toDelete = append(toDelete, id)
 			}
 		}
 		for _, id := range toDelete {
-			delete(s.jobs, id)
+			s.remove(id)
 		}
+		s.pruneHistory(now)
+		s.pruneBatches()
 		s.mu.Unlock()
 
 		for _, p := range pathsToDelete {
@@ -147,6 +491,102 @@ func (s *JobStore) cleanup() {
 	}
 }
 
+// expired reports whether a finished job has outlived the retention window,
+// or an unfinished one has been queued or paused longer than jobQueueTTL or
+// not kept alive for jobTTL while running. Callers must hold s.mu.
+func (s *JobStore) expired(j *Job, now time.Time) bool {
+	switch {
+	case !j.FinishedAt.IsZero():
+		return now.Sub(j.FinishedAt) > s.retention
+	case j.Status == JobPaused:
+		return now.Sub(j.pausedAt) > jobQueueTTL
+	case !j.StartedAt.IsZero():
+		return now.Sub(j.aliveAt) > jobTTL
+	}
+	return now.Sub(j.queuedAt) > jobQueueTTL
+}
+
+// LinkLifetime is the longest a job can exist, and so the longest a download
+// link for it needs to stay valid.
+func (s *JobStore) LinkLifetime() time.Duration {
+	return jobQueueTTL + jobTTL + s.retention
+}
+
+// ClaimLink marks a single-use link as spent and reports whether it was
+// still unused.
+func (s *JobStore) ClaimLink(id, sig string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j := s.jobs[id]
+	if j == nil || j.usedLinks[sig] {
+		return false
+	}
+	if j.usedLinks == nil {
+		j.usedLinks = make(map[string]bool)
+	}
+	j.usedLinks[sig] = true
+	return true
+}
+
+// RecordDownload counts a completed download and removes the job once it
+// reaches its download limit.
+func (s *JobStore) RecordDownload(id string) {
+	s.mu.Lock()
+	j := s.jobs[id]
+	if j == nil {
+		s.mu.Unlock()
+		return
+	}
+	j.Downloads++
+	spent := j.MaxDownloads > 0 && j.Downloads >= j.MaxDownloads
+	s.mu.Unlock()
+	if spent {
+		s.Cancel(id)
+	}
+}
+
+// abandoned reports whether an unfinished job has gone without listeners for
+// longer than the abandonment timeout since the last one left. Jobs nobody
+// has listened to, such as those whose clients poll their status, are never
+// abandoned. Callers must hold s.mu.
+func (s *JobStore) abandoned(j *Job, now time.Time) bool {
+	if s.abandonAfter <= 0 || j.Status == JobDone || j.Status == JobFailed {
+		return false
+	}
+	// Batch members are followed through their batch, not individually.
+	if j.BatchID != "" {
+		return false
+	}
+	if len(j.watchers) > 0 || j.unwatchedAt.IsZero() || now.Sub(j.unwatchedAt) <= s.abandonAfter {
+		return false
+	}
+	log.Printf("job %s abandoned after %s without listeners", j.ID, s.abandonAfter)
+	return true
+}
+
+// remove deletes a job, moves its record to history and releases its
+// subscribers. Callers must hold s.mu.
+func (s *JobStore) remove(id string) {
+	j := s.jobs[id]
+	if j == nil {
+		return
+	}
+	now := time.Now()
+	rec := j.record(now, false)
+	if j.FinishedAt.IsZero() {
+		rec.Status = JobCancelled
+		rec.FinishedAt = &now
+	}
+	if s.historyRetention > 0 {
+		s.history = append(s.history, rec)
+	}
+	for ch := range j.watchers {
+		close(ch)
+	}
+	j.watchers = nil
+	delete(s.jobs, id)
+}
+
 func randHex(n int) string {
 	b := make([]byte, n)
 	_, _ = rand.Read(b)
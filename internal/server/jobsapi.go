@@ -0,0 +1,150 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultJobsPageSize = 50
+	maxJobsPageSize     = 200
+)
+
+// JobsHandler serves GET /api/jobs. Query parameters: status (comma-separated),
+// since and until (RFC 3339, on creation time), limit and cursor. Admins may
+// also filter by owner and otherwise see every job.
+func JobsHandler(store *JobStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		owner, ok := jobOwner(w, r)
+		if !ok {
+			return
+		}
+		q := r.URL.Query()
+
+		var f JobFilter
+		if isAdmin(r) {
+			f.Owner = q.Get("owner")
+		} else if owner == "" {
+			writeJSON(w, http.StatusOK, jobsPage{Jobs: []JobRecord{}})
+			return
+		} else {
+			f.Owner = owner
+		}
+		if v := q.Get("status"); v != "" {
+			for _, st := range strings.Split(v, ",") {
+				f.Statuses = append(f.Statuses, JobStatus(strings.TrimSpace(st)))
+			}
+		}
+		var err error
+		if f.Since, err = parseTimeParam(q.Get("since")); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid since")
+			return
+		}
+		if f.Until, err = parseTimeParam(q.Get("until")); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid until")
+			return
+		}
+		limit := defaultJobsPageSize
+		if v := q.Get("limit"); v != "" {
+			if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+				writeError(w, http.StatusBadRequest, "invalid limit")
+				return
+			}
+			limit = min(limit, maxJobsPageSize)
+		}
+
+		recs := store.List(f)
+		if c := q.Get("cursor"); c != "" {
+			recs = afterCursor(recs, c)
+		}
+		page := jobsPage{Jobs: recs}
+		if len(recs) > limit {
+			page.Jobs = recs[:limit]
+			page.NextCursor = page.Jobs[limit-1].ID
+		}
+		if page.Jobs == nil {
+			page.Jobs = []JobRecord{}
+		}
+		writeJSON(w, http.StatusOK, page)
+	}
+}
+
+// JobHandler serves GET /api/jobs/{id} and POST /api/jobs/{id}/retry.
+func JobHandler(runner *Runner, analyzer *Analyzer) http.HandlerFunc {
+	store := runner.store
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/jobs/"), "/")
+		method := http.MethodGet
+		if sub == "retry" {
+			method = http.MethodPost
+		}
+		if r.Method != method {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		owner, ok := jobOwner(w, r)
+		if !ok {
+			return
+		}
+		rec, ok := store.Record(id)
+		if !ok || (!isAdmin(r) && (owner == "" || rec.Owner != owner)) {
+			writeError(w, http.StatusNotFound, "job not found")
+			return
+		}
+		switch sub {
+		case "":
+			writeJSON(w, http.StatusOK, rec)
+		case "waveform", "spectrogram":
+			job := store.snapshot(id)
+			if job == nil {
+				writeError(w, http.StatusGone, "job files have been removed")
+				return
+			}
+			serveAnalysis(w, r, analyzer, job, sub)
+		case "retry":
+			switch err := runner.Retry(id); {
+			case errors.Is(err, errJobNotFound), errors.Is(err, errInputRemoved):
+				writeError(w, http.StatusGone, "job files have been removed")
+			case errors.Is(err, errJobNotFailed):
+				writeError(w, http.StatusConflict, err.Error())
+			case err != nil:
+				writeError(w, http.StatusInternalServerError, err.Error())
+			default:
+				rec, _ := store.Record(id)
+				writeJSON(w, http.StatusAccepted, rec)
+			}
+		default:
+			writeError(w, http.StatusNotFound, "not found")
+		}
+	}
+}
+
+type jobsPage struct {
+	Jobs       []JobRecord `json:"jobs"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+}
+
+// afterCursor drops records up to and including the one with ID cursor.
+// An unknown cursor yields an empty page rather than restarting the listing.
+func afterCursor(recs []JobRecord, cursor string) []JobRecord {
+	for i, rec := range recs {
+		if rec.ID == cursor {
+			return recs[i+1:]
+		}
+	}
+	return nil
+}
+
+func parseTimeParam(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
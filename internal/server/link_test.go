@@ -0,0 +1,37 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLinkHandlerRequiresOwner(t *testing.T) {
+	store := NewJobStore()
+	links := &linkSigner{key: []byte("test")}
+	owner := randHex(16)
+	job := store.Create(JobSpec{Owner: "session:" + shortHash(owner)})
+	handler := LinkHandler(store, links)
+
+	for _, tc := range []struct {
+		name    string
+		session string
+		want    int
+	}{
+		{"owner", owner, http.StatusOK},
+		{"other session", randHex(16), http.StatusNotFound},
+		{"anonymous", "", http.StatusNotFound},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/convert/link/"+job.ID, nil)
+			if tc.session != "" {
+				req.AddCookie(&http.Cookie{Name: sessionCookie, Value: tc.session})
+			}
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+			if rec.Code != tc.want {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tc.want, rec.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+
+	"copyrem/pipeline"
+)
+
+// JobOutput is one rendition a job produces and the file it is written to.
+type JobOutput struct {
+	Rendition pipeline.Rendition
+	// Track is the 1-based track number in a split job, 0 otherwise.
+	Track    int
+	Path     string
+	Filename string
+	Size     int64
+	// CacheKey is the output's result cache key, once it has been produced.
+	CacheKey string
+}
+
+type OutputEvent struct {
+	Name    string `json:"name"`
+	Format  string `json:"format"`
+	Track   int    `json:"track,omitempty"`
+	Percent int    `json:"percent"`
+	Bytes   int64  `json:"bytes,omitempty"`
+}
+
+// newJobOutputs lays out one output per rendition in dir. A single
+// rendition keeps the plain "<name>_modified.<ext>" download name.
+func newJobOutputs(dir, baseName string, renditions []pipeline.Rendition) []JobOutput {
+	outs := make([]JobOutput, len(renditions))
+	for i, r := range renditions {
+		name := baseName + "_modified"
+		if len(renditions) > 1 {
+			name += "_" + r.Name
+		}
+		outs[i] = JobOutput{
+			Rendition: r,
+			Path:      filepath.Join(dir, randHex(8)+r.Ext()),
+			Filename:  name + r.Ext(),
+		}
+	}
+	return outs
+}
+
+func pipelineOutputs(outs []JobOutput) []pipeline.Output {
+	po := make([]pipeline.Output, len(outs))
+	for i, o := range outs {
+		po[i] = pipeline.Output{Rendition: o.Rendition, Path: o.Path}
+	}
+	return po
+}
+
+// output finds a job's output by rendition name; "" selects the first.
+func (j *Job) output(name string) (JobOutput, bool) {
+	for _, o := range j.Outputs {
+		if name == "" || o.Rendition.Name == name {
+			return o, true
+		}
+	}
+	return JobOutput{}, false
+}
+
+// files lists every file the job owns, for removal.
+func (j *Job) files() []string {
+	files := []string{j.InPath}
+	for _, o := range j.Outputs {
+		files = append(files, o.Path)
+	}
+	for _, p := range j.artifacts {
+		files = append(files, p)
+	}
+	return files
+}
+
+// outputSizes reads the sizes of a job's outputs from disk, without holding
+// the store lock meanwhile. Outputs that can't be read get -1.
+func (s *JobStore) outputSizes(id string) []int64 {
+	var paths []string
+	s.mu.RLock()
+	if j := s.jobs[id]; j != nil {
+		for _, o := range j.Outputs {
+			paths = append(paths, o.Path)
+		}
+	}
+	s.mu.RUnlock()
+	sizes := make([]int64, len(paths))
+	for i, p := range paths {
+		sizes[i] = -1
+		if fi, err := os.Stat(p); err == nil {
+			sizes[i] = fi.Size()
+		}
+	}
+	return sizes
+}
+
+// setSizes records sizes read by outputSizes. Callers must hold the store
+// lock.
+func (j *Job) setSizes(sizes []int64) {
+	for i := range j.Outputs {
+		if i < len(sizes) && sizes[i] >= 0 {
+			j.Outputs[i].Size = sizes[i]
+		}
+	}
+}
+
+func (j *Job) outputBytes() int64 {
+	var n int64
+	for _, o := range j.Outputs {
+		n += o.Size
+	}
+	return n
+}
+
+// outputEvents reports per-output progress. All renditions come out of one
+// ffmpeg run, so they advance together; the tracks of a split job share the
+// job's overall percentage.
+func (j *Job) outputEvents() []OutputEvent {
+	if len(j.Outputs) < 2 {
+		return nil
+	}
+	evs := make([]OutputEvent, len(j.Outputs))
+	for i, o := range j.Outputs {
+		evs[i] = OutputEvent{Name: o.Rendition.Name, Format: o.Rendition.Format, Track: o.Track, Percent: j.Percent, Bytes: o.Size}
+	}
+	return evs
+}
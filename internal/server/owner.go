@@ -0,0 +1,134 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const sessionCookie = "copyrem_session"
+
+var errBadAPIKey = errors.New("invalid API key")
+
+// apiKeys holds the keys from API_KEYS (comma-separated). A request that
+// presents one owns its jobs by key; browsers own theirs by session cookie.
+// Keys in ADMIN_API_KEYS also own jobs, and may list everyone's.
+var (
+	apiKeys   = loadAPIKeys("API_KEYS")
+	adminKeys = loadAPIKeys("ADMIN_API_KEYS")
+)
+
+func loadAPIKeys(env string) []string {
+	var keys []string
+	for _, k := range strings.Split(os.Getenv(env), ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+func presentedAPIKey(r *http.Request) string {
+	if k := r.Header.Get("X-API-Key"); k != "" {
+		return k
+	}
+	if a := r.Header.Get("Authorization"); strings.HasPrefix(a, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(a, "Bearer "))
+	}
+	return ""
+}
+
+// requestOwner identifies who is making the request, or returns "" for an
+// anonymous caller without a session.
+func requestOwner(r *http.Request) (string, error) {
+	if key := presentedAPIKey(r); key != "" {
+		if matchKey(key, apiKeys) || matchKey(key, adminKeys) {
+			return "key:" + shortHash(key), nil
+		}
+		return "", errBadAPIKey
+	}
+	if c, err := r.Cookie(sessionCookie); err == nil && validSessionID(c.Value) {
+		return "session:" + shortHash(c.Value), nil
+	}
+	return "", nil
+}
+
+func isAdmin(r *http.Request) bool {
+	key := presentedAPIKey(r)
+	return key != "" && matchKey(key, adminKeys)
+}
+
+func matchKey(key string, keys []string) bool {
+	for _, k := range keys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(k)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// shortHash derives an owner ID from a credential, so that owner IDs can be
+// listed and logged without revealing the credential itself.
+func shortHash(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:8])
+}
+
+// ensureOwner is requestOwner for uploads: anonymous callers get a new
+// session cookie so they can follow the job they are about to create.
+func ensureOwner(w http.ResponseWriter, r *http.Request) (string, error) {
+	owner, err := requestOwner(r)
+	if err != nil || owner != "" {
+		return owner, err
+	}
+	id := randHex(16)
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    id,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   isHTTPS(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return "session:" + shortHash(id), nil
+}
+
+func validSessionID(s string) bool {
+	if len(s) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+func isHTTPS(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	return os.Getenv("TRUST_PROXY") == "1" && r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+// queueClient identifies the client the scheduler shares the workers out
+// between: the API key of owners that have one, otherwise the address, since
+// anyone can start new sessions.
+func queueClient(r *http.Request, owner string) string {
+	if strings.HasPrefix(owner, "key:") {
+		return owner
+	}
+	return "ip:" + clientIP(r)
+}
+
+// jobOwner resolves the caller for a job endpoint, replying 401 if they
+// presented a bad API key.
+func jobOwner(w http.ResponseWriter, r *http.Request) (string, bool) {
+	owner, err := requestOwner(r)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err.Error())
+		return "", false
+	}
+	return owner, true
+}
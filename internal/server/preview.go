@@ -0,0 +1,96 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"copyrem/internal/config"
+	"copyrem/pipeline"
+)
+
+// previewSegment cuts a job's segment down to its first preview_length
+// (seconds or Go duration, default 20s). The job's fade-out only applies if
+// its end falls inside the window.
+func previewSegment(r *http.Request, seg pipeline.Segment) (pipeline.Segment, error) {
+	length := pipeline.DefaultPreviewLength
+	if v := r.FormValue("preview_length"); v != "" {
+		d, err := parseSeconds(v)
+		if err != nil || d <= 0 || d > pipeline.MaxPreviewLength {
+			return seg, fmt.Errorf("preview_length must be positive and at most %s", pipeline.MaxPreviewLength)
+		}
+		length = d
+	}
+	if end := seg.Start + length; seg.End == 0 || seg.End > end {
+		seg.End = end
+		seg.FadeOut = 0
+	}
+	seg.FadeIn = min(seg.FadeIn, seg.End-seg.Start)
+	return seg, nil
+}
+
+// previewRendition is the first audio rendition requested, or the default
+// MP3 when only video was.
+func previewRendition(cfg config.Params, renditions []pipeline.Rendition) pipeline.Rendition {
+	for _, r := range renditions {
+		if !r.IsVideo() {
+			return r
+		}
+	}
+	return cfg.DefaultRendition()
+}
+
+// servePreview renders a preview on the preview pool at low CPU priority and
+// streams it as it is encoded. The upload is removed afterwards.
+func servePreview(w http.ResponseWriter, r *http.Request, previews *Pool, inPath string, rendition pipeline.Rendition, opts pipeline.Options) {
+	defer os.Remove(inPath)
+	ctx := r.Context()
+	opts.OnStart = func(p *os.Process) {
+		_ = setProcessNice(p, opts.Limits.Nice+PriorityLow.nice())
+	}
+	out := &previewWriter{w: w, rc: http.NewResponseController(w), mime: rendition.StreamMIMEType()}
+	done := make(chan error, 1)
+	previews.Submit(func() {
+		if err := ctx.Err(); err != nil {
+			done <- err
+			return
+		}
+		done <- pipeline.Preview(ctx, inPath, out, rendition, opts)
+	})
+	err := <-done
+	switch {
+	case err == nil || ctx.Err() != nil:
+	case out.started:
+		log.Printf("preview failed mid-stream: %v", err)
+	default:
+		if !errors.Is(err, pipeline.ErrInvalidOptions) {
+			log.Printf("preview failed: %v", err)
+		}
+		writeFailure(w, err)
+	}
+}
+
+// previewWriter sends the response headers with the first audio bytes, so
+// errors before that can still be reported as JSON, and flushes every write.
+type previewWriter struct {
+	w       http.ResponseWriter
+	rc      *http.ResponseController
+	mime    string
+	started bool
+}
+
+func (p *previewWriter) Write(b []byte) (int, error) {
+	if !p.started {
+		p.started = true
+		p.w.Header().Set("Content-Type", p.mime)
+		p.w.Header().Set("Cache-Control", "no-store")
+		p.w.WriteHeader(http.StatusOK)
+	}
+	n, err := p.w.Write(b)
+	if err == nil {
+		err = p.rc.Flush()
+	}
+	return n, err
+}
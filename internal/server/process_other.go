@@ -0,0 +1,22 @@
+//go:build !unix
+
+package server
+
+import (
+	"errors"
+	"os"
+)
+
+var errProcessControl = errors.New("process control not supported on this platform")
+
+func suspendProcess(p *os.Process) error {
+	return errProcessControl
+}
+
+func resumeProcess(p *os.Process) error {
+	return errProcessControl
+}
+
+func setProcessNice(p *os.Process, nice int) error {
+	return errProcessControl
+}
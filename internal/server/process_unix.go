@@ -0,0 +1,20 @@
+//go:build unix
+
+package server
+
+import (
+	"os"
+	"syscall"
+)
+
+func suspendProcess(p *os.Process) error {
+	return p.Signal(syscall.SIGSTOP)
+}
+
+func resumeProcess(p *os.Process) error {
+	return p.Signal(syscall.SIGCONT)
+}
+
+func setProcessNice(p *os.Process, nice int) error {
+	return syscall.Setpriority(syscall.PRIO_PROCESS, p.Pid, nice)
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"log"
+
+	"copyrem/pipeline"
+)
+
+// bandwidthLoss flags outputs whose bandwidth falls below this share of the
+// input's.
+const bandwidthLoss = 0.8
+
+// QualityReport compares the part of a job's input that was converted with
+// each of its outputs, to catch settings that clip or dull the audio.
+type QualityReport struct {
+	Input   pipeline.AudioStats `json:"input"`
+	Outputs []OutputQuality     `json:"outputs"`
+}
+
+type OutputQuality struct {
+	Rendition string `json:"rendition"`
+	pipeline.AudioStats
+	SNR      float64 `json:"snr_db"`
+	OffsetMs float64 `json:"offset_ms"`
+	// Warnings holds "clipping" when the output clips more than the input
+	// or peaks above 0 dBTP, and "bandwidth_loss" when it has lost highs.
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+func (s *JobStore) SetQualityReport(id string, rep *QualityReport) {
+	s.update(id, func(j *Job) {
+		j.QualityReport = rep
+	})
+}
+
+// measureJob builds a job's quality report, or returns nil if the input or
+// an output could not be measured.
+func measureJob(job *Job, opts pipeline.Options) *QualityReport {
+	opts.OnProgress, opts.OnStart, opts.OnExit = nil, nil, nil
+	in, err := pipeline.Measure(job.Ctx, job.InPath, opts)
+	if err != nil {
+		logQuality(job, err)
+		return nil
+	}
+	rep := &QualityReport{Input: in}
+	for _, o := range job.Outputs {
+		out, err := pipeline.Measure(job.Ctx, o.Path, pipeline.Options{Backend: opts.Backend, Binary: opts.Binary, Limits: opts.Limits})
+		var c pipeline.Comparison
+		if err == nil {
+			c, err = pipeline.Compare(job.Ctx, job.InPath, o.Path, opts)
+		}
+		if err != nil {
+			logQuality(job, err)
+			return nil
+		}
+		rep.Outputs = append(rep.Outputs, OutputQuality{
+			Rendition:  o.Rendition.Name,
+			AudioStats: out,
+			SNR:        c.SNR,
+			OffsetMs:   float64(c.Offset.Microseconds()) / 1000,
+			Warnings:   qualityWarnings(in, out),
+		})
+	}
+	return rep
+}
+
+func qualityWarnings(in, out pipeline.AudioStats) []string {
+	var w []string
+	if out.Clipped > in.Clipped || (out.TruePeak > 0 && in.TruePeak <= 0) {
+		w = append(w, "clipping")
+	}
+	if out.Bandwidth < in.Bandwidth*bandwidthLoss {
+		w = append(w, "bandwidth_loss")
+	}
+	return w
+}
+
+func logQuality(job *Job, err error) {
+	if job.Ctx.Err() == nil {
+		log.Printf("job %s: quality report: %v", job.ID, err)
+	}
+}
@@ -0,0 +1,297 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"copyrem/pipeline"
+)
+
+// errLeaseLost stops a worker's conversion when the coordinator no longer
+// holds its lease, because it expired or the job was cancelled.
+var errLeaseLost = errors.New("lease lost")
+
+// workerRetryWait is how long a worker waits after failing to reach the
+// coordinator.
+const workerRetryWait = 5 * time.Second
+
+// Worker converts jobs leased from a Coordinator, so that encoding can run
+// on other machines than the web tier.
+type Worker struct {
+	// URL is the coordinator's base URL.
+	URL   string
+	Token string
+	// Name identifies the worker in the coordinator's log.
+	Name string
+	// Concurrency is how many jobs it converts at once; zero means one.
+	Concurrency int
+	// Options hold the backend, binary and limits conversions run with.
+	Options pipeline.Options
+	// Client makes the requests; nil means http.DefaultClient.
+	Client *http.Client
+}
+
+// NewWorker configures a worker for COORDINATOR_URL with WORKER_TOKEN. It
+// converts WORKERS jobs at once (default: CPU count), named WORKER_NAME
+// (default: the host name), and reads BACKEND and the process limits as the
+// server does.
+func NewWorker() (*Worker, error) {
+	wk := &Worker{
+		URL:         strings.TrimSuffix(os.Getenv("COORDINATOR_URL"), "/"),
+		Token:       os.Getenv("WORKER_TOKEN"),
+		Name:        os.Getenv("WORKER_NAME"),
+		Concurrency: envInt("WORKERS", runtime.NumCPU()),
+		Options:     pipeline.Options{Backend: envBackend(), Limits: envLimits()},
+	}
+	if wk.URL == "" || wk.Token == "" {
+		return nil, errors.New("COORDINATOR_URL and WORKER_TOKEN must be set")
+	}
+	if wk.Name == "" {
+		wk.Name, _ = os.Hostname()
+	}
+	return wk, nil
+}
+
+// Run takes and converts jobs until ctx ends.
+func (wk *Worker) Run(ctx context.Context) error {
+	var wg sync.WaitGroup
+	for range max(wk.Concurrency, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				a, err := wk.lease(ctx)
+				switch {
+				case err != nil && ctx.Err() == nil:
+					log.Printf("worker: %v", err)
+					select {
+					case <-time.After(workerRetryWait):
+					case <-ctx.Done():
+					}
+				case a != nil:
+					wk.process(ctx, a)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return ctx.Err()
+}
+
+// lease asks the coordinator for a job. It returns nil when none came up.
+func (wk *Worker) lease(ctx context.Context) (*assignment, error) {
+	resp, err := wk.request(ctx, http.MethodPost, "/api/worker/lease?worker="+url.QueryEscape(wk.Name), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNoContent {
+		return nil, nil
+	}
+	var a assignment
+	if err := json.NewDecoder(resp.Body).Decode(&a); err != nil {
+		return nil, fmt.Errorf("lease: %w", err)
+	}
+	return &a, nil
+}
+
+// process converts a leased job and completes the lease, sending heartbeats
+// until then.
+func (wk *Worker) process(ctx context.Context, a *assignment) {
+	jobCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	var mu sync.Mutex
+	var progress pipeline.Progress
+	beats := make(chan struct{})
+	go func() {
+		defer close(beats)
+		every := time.Duration(a.HeartbeatSeconds * float64(time.Second))
+		if every <= 0 {
+			every = 10 * time.Second
+		}
+		tick := time.NewTicker(every)
+		defer tick.Stop()
+		for {
+			select {
+			case <-jobCtx.Done():
+				return
+			case <-tick.C:
+			}
+			mu.Lock()
+			p := progress
+			mu.Unlock()
+			if err := wk.send(jobCtx, a, "heartbeat", p); errors.Is(err, errLeaseLost) {
+				cancel(err)
+				return
+			} else if err != nil && jobCtx.Err() == nil {
+				log.Printf("worker: job %s: heartbeat: %v", a.JobID, err)
+			}
+		}
+	}()
+
+	err := wk.convert(jobCtx, a, func(p pipeline.Progress) {
+		mu.Lock()
+		progress = p
+		mu.Unlock()
+	})
+	cancel(nil)
+	<-beats
+	if errors.Is(err, errLeaseLost) || errors.Is(context.Cause(jobCtx), errLeaseLost) {
+		log.Printf("worker: job %s: lease lost", a.JobID)
+		return
+	}
+
+	var done completion
+	switch {
+	case err != nil && ctx.Err() != nil:
+		// Hand the job back rather than leave it until the lease expires.
+		done = completion{Error: "worker stopped", Code: pipeline.CodeInternal, Transient: true}
+	case err != nil:
+		log.Printf("worker: job %s failed: %v", a.JobID, err)
+		code := pipeline.ErrorCode(err)
+		if code == "" {
+			code = pipeline.CodeInternal
+		}
+		done = completion{Error: err.Error(), Code: code, Transient: pipeline.Transient(err)}
+	}
+	if err := wk.send(context.WithoutCancel(ctx), a, "complete", done); err != nil {
+		log.Printf("worker: job %s: complete: %v", a.JobID, err)
+	}
+}
+
+// convert downloads the input of a leased job, converts it and uploads the
+// outputs.
+func (wk *Worker) convert(ctx context.Context, a *assignment, onProgress func(pipeline.Progress)) error {
+	dir, err := os.MkdirTemp(wk.Options.Limits.Dir, "lease-"+a.JobID+"-")
+	if err != nil {
+		return fmt.Errorf("work dir: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	input := filepath.Join(dir, "input"+a.InputExt)
+	if err := wk.download(ctx, a, input); err != nil {
+		return err
+	}
+	opts := wk.Options
+	opts.Params, opts.Intensity, opts.Segment, opts.Metadata = a.Params, a.Intensity, a.Segment, a.Metadata
+	opts.Limits.Dir = dir
+	opts.OnProgress = onProgress
+
+	outputs := make([]pipeline.Output, len(a.Outputs))
+	for i, o := range a.Outputs {
+		outputs[i] = pipeline.Output{Rendition: o.Rendition, Path: filepath.Join(dir, fmt.Sprintf("%d-%s", i, o.Name))}
+	}
+	if a.Tracks != nil {
+		outs := make([][]pipeline.Output, len(a.Tracks.Tracks))
+		for i, o := range a.Outputs {
+			outs[o.Track-1] = append(outs[o.Track-1], outputs[i])
+		}
+		err = pipeline.ConvertTracks(ctx, input, *a.Tracks, outs, opts)
+	} else {
+		err = pipeline.ConvertOutputs(ctx, input, outputs, opts)
+	}
+	if err != nil {
+		return err
+	}
+	for i, o := range outputs {
+		if err := wk.upload(ctx, a, i, o.Path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (wk *Worker) download(ctx context.Context, a *assignment, path string) error {
+	resp, err := wk.request(ctx, http.MethodGet, "/api/worker/leases/"+a.Lease+"/input", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, resp.Body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("download input: %w", err)
+	}
+	return nil
+}
+
+func (wk *Worker) upload(ctx context.Context, a *assignment, i int, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	resp, err := wk.request(ctx, http.MethodPut, fmt.Sprintf("/api/worker/leases/%s/outputs/%d", a.Lease, i), f)
+	if err != nil {
+		return fmt.Errorf("upload output: %w", err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// send posts v as JSON to a lease endpoint.
+func (wk *Worker) send(ctx context.Context, a *assignment, endpoint string, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	resp, err := wk.request(ctx, http.MethodPost, "/api/worker/leases/"+a.Lease+"/"+endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// request calls the coordinator. Error statuses become errors, and a lease
+// the coordinator no longer knows becomes errLeaseLost.
+func (wk *Worker) request(ctx context.Context, method, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, wk.URL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+wk.Token)
+	if body != nil && method == http.MethodPost {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	client := wk.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusGone {
+		return nil, errLeaseLost
+	}
+	var e struct {
+		Error string `json:"error"`
+	}
+	_ = json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&e)
+	return nil, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, e.Error)
+}
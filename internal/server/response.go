@@ -3,6 +3,8 @@ package server
 import (
 	"encoding/json"
 	"net/http"
+
+	"copyrem/pipeline"
 )
 
 func writeJSON(w http.ResponseWriter, status int, v any) {
@@ -11,8 +13,86 @@ func writeJSON(w http.ResponseWriter, status int, v any) {
 	_ = json.NewEncoder(w).Encode(v)
 }
 
+// writeError writes a JSON error whose code follows from status.
 func writeError(w http.ResponseWriter, status int, message string) {
+	code, ok := statusCodes[status]
+	if !ok {
+		code = string(pipeline.CodeInternal)
+	}
+	writeErrorCode(w, status, code, message)
+}
+
+func writeErrorCode(w http.ResponseWriter, status int, code, message string) {
 	writeJSON(w, status, struct {
 		Error string `json:"error"`
-	}{Error: message})
+		Code  string `json:"code"`
+	}{Error: message, Code: code})
+}
+
+// statusCodes are the codes of errors the server tells apart by status.
+var statusCodes = map[int]string{
+	http.StatusBadRequest:            "invalid_request",
+	http.StatusUnauthorized:          "unauthorized",
+	http.StatusForbidden:             "forbidden",
+	http.StatusNotFound:              "not_found",
+	http.StatusMethodNotAllowed:      "method_not_allowed",
+	http.StatusConflict:              "conflict",
+	http.StatusGone:                  "gone",
+	http.StatusRequestEntityTooLarge: "too_large",
+	http.StatusUpgradeRequired:       "upgrade_required",
+	http.StatusTooManyRequests:       "rate_limited",
+}
+
+// failureMessages are what users are told about pipeline failures. The
+// errors themselves can quote ffmpeg, which names files on the server, so
+// they only go to the log.
+var failureMessages = map[pipeline.Code]string{
+	pipeline.CodeUnsupportedCodec: "The file's format or codec is not supported.",
+	pipeline.CodeCorruptInput:     "The file could not be read. It may be damaged or not be audio.",
+	pipeline.CodeNoAudioStream:    "The file has no audio.",
+	pipeline.CodeTooLong:          "The file is too long to process.",
+	pipeline.CodeTimeout:          "Processing took too long and was stopped.",
+	pipeline.CodeResourceLimit:    "Processing exceeded the server's resource limits and was stopped.",
+	pipeline.CodeInternal:         "Processing failed. Please try again later.",
+}
+
+var failureStatus = map[pipeline.Code]int{
+	pipeline.CodeInvalidOptions:   http.StatusBadRequest,
+	pipeline.CodeUnsupportedCodec: http.StatusUnprocessableEntity,
+	pipeline.CodeCorruptInput:     http.StatusUnprocessableEntity,
+	pipeline.CodeNoAudioStream:    http.StatusUnprocessableEntity,
+	pipeline.CodeTooLong:          http.StatusRequestEntityTooLarge,
+	pipeline.CodeTimeout:          http.StatusServiceUnavailable,
+	pipeline.CodeResourceLimit:    http.StatusUnprocessableEntity,
+	pipeline.CodeInternal:         http.StatusInternalServerError,
+}
+
+// publicError returns the code of a pipeline failure and a message that is
+// safe to show users. Errors from outside the pipeline are internal.
+func publicError(err error) (pipeline.Code, string) {
+	code := pipeline.ErrorCode(err)
+	switch code {
+	case "":
+		code = pipeline.CodeInternal
+	case pipeline.CodeInvalidOptions:
+		// These describe the request, not the server.
+		return code, err.Error()
+	}
+	return code, failureMessages[code]
+}
+
+// writeFailure reports a pipeline failure with publicError.
+func writeFailure(w http.ResponseWriter, err error) {
+	code, msg := publicError(err)
+	writeErrorCode(w, failureStatus[code], string(code), msg)
+}
+
+// writeRequestError reports err from checking a request: pipeline errors as
+// writeFailure does, others as invalid requests.
+func writeRequestError(w http.ResponseWriter, err error) {
+	if pipeline.ErrorCode(err) == "" {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeFailure(w, err)
 }
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"copyrem/internal/cache"
+)
+
+const defaultCacheMaxMB = 1024
+
+// openResultCache sets up the conversion result cache from CACHE_DIR and
+// CACHE_MAX_MB. It returns nil, disabling caching, when CACHE_MAX_MB is 0
+// or the directory cannot be used.
+func openResultCache() *cache.Cache {
+	maxMB := envInt("CACHE_MAX_MB", defaultCacheMaxMB)
+	if maxMB == 0 {
+		return nil
+	}
+	dir := os.Getenv("CACHE_DIR")
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "copyrem-cache")
+	}
+	c, err := cache.Open(dir, int64(maxMB)<<20)
+	if err != nil {
+		log.Printf("result cache disabled: %v", err)
+		return nil
+	}
+	return c
+}
+
+// CacheStatsHandler serves GET /api/cache to admins.
+func CacheStatsHandler(results *cache.Cache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		if !isAdmin(r) {
+			writeError(w, http.StatusNotFound, "not found")
+			return
+		}
+		if results == nil {
+			writeJSON(w, http.StatusOK, struct {
+				Enabled bool `json:"enabled"`
+			}{false})
+			return
+		}
+		writeJSON(w, http.StatusOK, struct {
+			Enabled bool `json:"enabled"`
+			cache.Stats
+		}{true, results.Stats()})
+	}
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"copyrem/pipeline"
+)
+
+var (
+	errJobNotFailed = errors.New("job has not failed")
+	errInputRemoved = errors.New("job input has been removed")
+)
+
+// RetryPolicy decides how often, and after how long, jobs that failed for a
+// transient reason run again.
+type RetryPolicy struct {
+	// MaxAttempts counts the first run; 1 disables retries.
+	MaxAttempts int
+	// Backoff is the wait before the first retry. It doubles with every
+	// further retry, up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+func envRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: envInt("JOB_MAX_ATTEMPTS", 3),
+		Backoff:     envDuration("JOB_RETRY_BACKOFF", 5*time.Second),
+		MaxBackoff:  envDuration("JOB_RETRY_MAX_BACKOFF", time.Minute),
+	}
+}
+
+// next returns the wait before another attempt at a job that has run tries
+// times, or false if it has had all its attempts.
+func (p RetryPolicy) next(tries int) (time.Duration, bool) {
+	if tries >= p.MaxAttempts {
+		return 0, false
+	}
+	wait := p.Backoff
+	for range tries - 1 {
+		if p.MaxBackoff > 0 && wait >= p.MaxBackoff {
+			break
+		}
+		wait *= 2
+	}
+	if p.MaxBackoff > 0 {
+		wait = min(wait, p.MaxBackoff)
+	}
+	return wait, true
+}
+
+// JobAttempt records a failed run of a job.
+type JobAttempt struct {
+	StartedAt  time.Time     `json:"started_at"`
+	FinishedAt time.Time     `json:"finished_at"`
+	Error      string        `json:"error"`
+	ErrorCode  pipeline.Code `json:"error_code"`
+	// Retried reports whether the job was queued again on its own.
+	Retried bool `json:"retried"`
+}
+
+// attempt returns the number of the job's current or last run, counting
+// runs before manual retries too. Callers must hold the store lock.
+func (j *Job) attempt() int {
+	if j.Status == JobFailed {
+		return len(j.Attempts)
+	}
+	return len(j.Attempts) + 1
+}
+
+// setQueued records what a job runs with, the length of its input and what
+// it is expected to cost, for retries and the job history.
+func (s *JobStore) setQueued(id string, opts pipeline.Options, duration, cost time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if j := s.jobs[id]; j != nil {
+		j.opts, j.duration, j.cost = opts, duration, cost
+	}
+}
+
+// tries returns how many times the job has run since it was created or last
+// retried by hand.
+func (s *JobStore) tries(id string) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if j := s.jobs[id]; j != nil {
+		return j.tries
+	}
+	return 0
+}
+
+// SetRetrying records a failed attempt and puts the job back in the queue.
+func (s *JobStore) SetRetrying(id string, code pipeline.Code, errMsg string) {
+	s.update(id, func(j *Job) {
+		j.addAttempt(code, errMsg, true)
+		j.requeue()
+	})
+}
+
+// SetUnclaimed puts back in the queue a job that was taken for a remote
+// worker that then stopped waiting, without counting the run.
+func (s *JobStore) SetUnclaimed(id string) {
+	s.update(id, func(j *Job) {
+		j.tries--
+		j.requeue()
+	})
+}
+
+// Retry puts a failed job whose input is still kept back in the queue, with
+// a fresh set of attempts, and returns the options it ran with.
+func (s *JobStore) Retry(id string) (pipeline.Options, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j := s.jobs[id]
+	switch {
+	case j == nil:
+		return pipeline.Options{}, errJobNotFound
+	case j.Status != JobFailed:
+		return pipeline.Options{}, errJobNotFailed
+	}
+	if _, err := os.Stat(j.InPath); err != nil {
+		return pipeline.Options{}, errInputRemoved
+	}
+	j.tries = 0
+	j.requeue()
+	if len(j.watchers) == 0 && !j.unwatchedAt.IsZero() {
+		j.unwatchedAt = time.Now()
+	}
+	s.publish(j)
+	return j.opts, nil
+}
+
+// addAttempt records the run that just failed. Callers must hold the store
+// lock.
+func (j *Job) addAttempt(code pipeline.Code, errMsg string, retried bool) {
+	j.Attempts = append(j.Attempts, JobAttempt{
+		StartedAt:  j.StartedAt,
+		FinishedAt: time.Now(),
+		Error:      errMsg,
+		ErrorCode:  code,
+		Retried:    retried,
+	})
+}
+
+// requeue clears the state of the last run. Callers must hold the store
+// lock.
+func (j *Job) requeue() {
+	j.Status = JobPending
+	j.Percent = 0
+	j.Progress = pipeline.Progress{}
+	j.Error, j.ErrorCode = "", ""
+	j.Cached = false
+	j.QualityReport = nil
+	j.proc = nil
+	j.StartedAt, j.FinishedAt = time.Time{}, time.Time{}
+	j.queuedAt = time.Now()
+	j.pausedAt, j.pausedFor = time.Time{}, 0
+}
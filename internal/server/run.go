@@ -0,0 +1,234 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"copyrem/internal/cache"
+	"copyrem/pipeline"
+)
+
+// Runner executes jobs from a JobStore on a worker pool.
+type Runner struct {
+	store    *JobStore
+	results  *cache.Cache
+	analyzer *Analyzer
+	pool     *Pool
+	retry    RetryPolicy
+}
+
+func NewRunner(store *JobStore, results *cache.Cache, analyzer *Analyzer, pool *Pool) *Runner {
+	return &Runner{store: store, results: results, analyzer: analyzer, pool: pool, retry: envRetryPolicy()}
+}
+
+// Enqueue queues a pending job; it runs once the pool picks it. The pool is
+// charged the length of the input it converts.
+func (rn *Runner) Enqueue(job *Job, opts pipeline.Options) {
+	var duration, cost time.Duration
+	if d, err := pipeline.Duration(job.InPath, opts); err == nil {
+		duration, cost = d, opts.Segment.Length(d)
+	}
+	rn.store.setQueued(job.ID, opts, duration, cost)
+	rn.submit(job, opts)
+}
+
+func (rn *Runner) submit(job *Job, opts pipeline.Options) {
+	rn.pool.SubmitTask(Task{
+		Run:      func() { rn.run(job, opts, convertJob) },
+		Client:   job.Client,
+		Priority: func() Priority { return rn.store.priority(job.ID) },
+		Cost:     job.cost,
+		Job:      job,
+		Opts:     opts,
+	})
+}
+
+// run runs a job, converting it with convert.
+func (rn *Runner) run(job *Job, opts pipeline.Options, convert func(*Job, pipeline.Options) error) {
+	if err := runJob(rn.store, rn.results, rn.analyzer, job, opts, convert); err != nil {
+		rn.fail(job, opts, err)
+	}
+}
+
+// runJob converts a job's input, serving it from the result cache when every
+// rendition has been produced by an identical conversion before, then runs
+// the analysis stage if the job asks for a quality report or analysis. The
+// input of a failed job is kept so that it can be retried.
+func runJob(store *JobStore, results *cache.Cache, analyzer *Analyzer, job *Job, opts pipeline.Options, convert func(*Job, pipeline.Options) error) error {
+	if job.Ctx.Err() != nil {
+		return nil
+	}
+	store.SetRunning(job.ID)
+	defer store.keepAlive(job.ID)()
+	// The runner works on copies of the job, since its outputs change
+	// under the store lock meanwhile.
+	if job = store.snapshot(job.ID); job == nil {
+		return nil
+	}
+
+	// ffmpeg runs in a directory of its own, so nothing it leaves behind
+	// outlives the job.
+	dir, err := os.MkdirTemp(opts.Limits.Dir, "job-"+job.ID+"-")
+	if err != nil {
+		return fmt.Errorf("work dir: %w", err)
+	}
+	defer os.RemoveAll(dir)
+	opts.Limits.Dir = dir
+
+	opts.OnProgress = func(p pipeline.Progress) {
+		store.SetProgress(job.ID, p)
+	}
+	opts.OnStart = func(p *os.Process) {
+		store.SetProcess(job.ID, p, opts.Limits.Nice)
+	}
+	opts.OnExit = func(p *os.Process) {
+		store.ClearProcess(job.ID, p)
+	}
+	opts.Paused = func() time.Duration { return store.paused(job.ID) }
+	if err := detectTracks(store, job, opts); err != nil {
+		return err
+	}
+	if job = store.snapshot(job.ID); job == nil {
+		return nil
+	}
+
+	keys := cacheKeys(results, job, opts)
+	cached := keys != nil && fromCache(results, job, keys)
+	if !cached {
+		if err := convert(job, opts); err != nil {
+			return err
+		}
+		for i, key := range keys {
+			if err := results.Put(key, job.Outputs[i].Path); err != nil {
+				log.Printf("job %s: cache put: %v", job.ID, err)
+			}
+		}
+	}
+	store.setOutputKeys(job.ID, keys)
+	if job = store.snapshot(job.ID); job == nil {
+		return nil
+	}
+
+	if job.Analyze || job.Quality {
+		store.SetAnalyzing(job.ID)
+	}
+	if job.Quality {
+		store.SetQualityReport(job.ID, measureJob(job, opts))
+	}
+	if job.Analyze {
+		analyzer.Precompute(job)
+	} else {
+		_ = os.Remove(job.InPath)
+	}
+	if job.Ctx.Err() != nil {
+		return nil
+	}
+	if cached {
+		store.SetCached(job.ID)
+	} else {
+		store.SetDone(job.ID)
+	}
+	return nil
+}
+
+// fail records a failed attempt at a job. Transient failures are queued
+// again after a backoff while the retry policy allows more attempts.
+func (rn *Runner) fail(job *Job, opts pipeline.Options, err error) {
+	if job.Ctx.Err() == context.Canceled {
+		return
+	}
+	log.Printf("job %s failed: %v", job.ID, err)
+	code, msg := publicError(err)
+	if !pipeline.Transient(err) {
+		rn.store.SetFailed(job.ID, code, msg)
+		return
+	}
+	wait, ok := rn.retry.next(rn.store.tries(job.ID))
+	if !ok {
+		rn.store.SetFailed(job.ID, code, msg)
+		return
+	}
+	log.Printf("job %s: retrying in %s", job.ID, wait)
+	rn.store.SetRetrying(job.ID, code, msg)
+	time.AfterFunc(wait, func() {
+		if job.Ctx.Err() == nil {
+			rn.submit(job, opts)
+		}
+	})
+}
+
+// Retry queues a failed job again with the options it first ran with.
+func (rn *Runner) Retry(id string) error {
+	opts, err := rn.store.Retry(id)
+	if err != nil {
+		return err
+	}
+	if job := rn.store.Get(id); job != nil {
+		rn.submit(job, opts)
+	}
+	return nil
+}
+
+// detectTracks finds the tracks of a silence split job.
+func detectTracks(store *JobStore, job *Job, opts pipeline.Options) error {
+	// A retried job keeps the tracks found on its first attempt.
+	if job.Split == nil || job.Split.Silence == nil || job.Tracks != nil {
+		return nil
+	}
+	tracks, err := pipeline.DetectTracks(job.Ctx, job.InPath, opts, *job.Split.Silence)
+	if err != nil {
+		return err
+	}
+	if len(tracks) == 0 {
+		return errors.New("no audio found between silences")
+	}
+	album := strings.TrimSuffix(job.InputName, filepath.Ext(job.InputName))
+	store.SetTracks(job.ID, pipeline.TrackList{Title: album, Tracks: tracks})
+	return nil
+}
+
+func convertJob(job *Job, opts pipeline.Options) error {
+	if job.Tracks != nil {
+		return pipeline.ConvertTracks(job.Ctx, job.InPath, *job.Tracks, trackOutputs(job), opts)
+	}
+	return pipeline.ConvertOutputs(job.Ctx, job.InPath, pipelineOutputs(job.Outputs), opts)
+}
+
+func cacheKeys(results *cache.Cache, job *Job, opts pipeline.Options) []string {
+	if results == nil || job.InputSHA256 == "" {
+		return nil
+	}
+	keys := make([]string, len(job.Outputs))
+	for i, o := range job.Outputs {
+		oopts := opts
+		if job.Tracks != nil {
+			oopts = job.Tracks.Options(opts, o.Track-1)
+		}
+		key, err := pipeline.CacheKey(job.InputSHA256, oopts, o.Rendition)
+		if err != nil {
+			log.Printf("job %s: cache key: %v", job.ID, err)
+			return nil
+		}
+		keys[i] = key
+	}
+	return keys
+}
+
+// fromCache fills every output from the cache, or none of them.
+func fromCache(results *cache.Cache, job *Job, keys []string) bool {
+	for i, key := range keys {
+		if !results.Get(key, job.Outputs[i].Path) {
+			for _, o := range job.Outputs[:i] {
+				_ = os.Remove(o.Path)
+			}
+			return false
+		}
+	}
+	return true
+}
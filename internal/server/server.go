@@ -4,9 +4,11 @@ import (
 	_ "embed"
 	"net/http"
 	"os"
+	"runtime"
 	"strings"
 
 	"copyrem/internal/config"
+	"copyrem/pipeline"
 )
 
 //go:embed static/build.html
@@ -15,12 +17,36 @@ var buildHTML []byte
 func NewMux(cfg config.Params, staticDir string) *http.ServeMux {
 	mux := http.NewServeMux()
 	store := NewJobStore()
+	links := newLinkSigner()
+	results := openResultCache()
+	base := pipeline.Options{Params: cfg, Intensity: 1.0, Backend: envBackend(), Limits: envLimits()}
+	analyzer := NewAnalyzer(store, results, base)
+	// With WORKER_TOKEN set, jobs are converted by remote workers.
+	remote := os.Getenv("WORKER_TOKEN") != ""
+	var pool *Pool
+	if remote {
+		pool = NewRemotePool()
+	} else {
+		pool = NewPool(runtime.NumCPU())
+	}
+	runner := NewRunner(store, results, analyzer, pool)
 
-	mux.HandleFunc("/api/info", InfoHandler())
-	mux.HandleFunc("/convert", RateLimitConvert(ConvertHandler(cfg, store)))
+	mux.HandleFunc("/api/info", InfoHandler(base.Backend))
+	mux.HandleFunc("/api/jobs", JobsHandler(store))
+	mux.HandleFunc("/api/jobs/", JobHandler(runner, analyzer))
+	mux.HandleFunc("/api/cache", CacheStatsHandler(results))
+	if remote {
+		mux.HandleFunc("/api/worker/", WorkerHandler(NewCoordinator(runner)))
+	}
+	mux.HandleFunc("/convert", RateLimitConvert(ConvertHandler(base, runner, NewPreviewPool(), links)))
+	mux.HandleFunc("/convert/batch", RateLimitConvert(BatchHandler(base, runner)))
+	mux.HandleFunc("/convert/batch/", BatchStatusHandler(store))
 	mux.HandleFunc("/convert/progress/", ProgressHandler(store))
 	mux.HandleFunc("/convert/cancel/", CancelHandler(store))
-	mux.HandleFunc("/convert/download/", DownloadHandler(store))
+	mux.HandleFunc("/convert/download/", DownloadHandler(store, links))
+	mux.HandleFunc("/convert/link/", LinkHandler(store, links))
+	mux.HandleFunc("/convert/ws", WebSocketHandler(store))
+	mux.HandleFunc("/convert/ws/", WebSocketHandler(store))
 
 	var staticHandler http.Handler
 	if staticDir != "" {
@@ -69,7 +95,8 @@ func CORS(next http.Handler) http.Handler {
 		if origin != "" && allowed[origin] {
 			w.Header().Set("Access-Control-Allow-Origin", origin)
 			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key")
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
 			w.Header().Set("Access-Control-Max-Age", "86400")
 		}
 		if r.Method == http.MethodOptions {
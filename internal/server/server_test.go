@@ -0,0 +1,473 @@
+package server
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"copyrem/pipeline"
+)
+
+type testServer struct {
+	*httptest.Server
+	store  *JobStore
+	client *http.Client
+}
+
+// newTestServer serves the conversion endpoints with backend in place of
+// ffmpeg. Uploads and outputs go to a temporary directory.
+func newTestServer(t *testing.T, backend pipeline.Backend) *testServer {
+	t.Helper()
+	t.Setenv("TMPDIR", t.TempDir())
+	store := NewJobStore()
+	links := &linkSigner{key: []byte("test")}
+	runner := NewRunner(store, nil, nil, newPool(2))
+	base := pipeline.DefaultOptions()
+	base.Backend = backend
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/convert", ConvertHandler(base, runner, newPool(1), links))
+	mux.HandleFunc("/convert/batch", BatchHandler(base, runner))
+	mux.HandleFunc("/convert/batch/", BatchStatusHandler(store))
+	mux.HandleFunc("/convert/progress/", ProgressHandler(store))
+	mux.HandleFunc("/convert/download/", DownloadHandler(store, links))
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testServer{Server: srv, store: store, client: &http.Client{Jar: jar}}
+}
+
+type testFile struct {
+	name    string
+	content string
+}
+
+// post sends a multipart form with files in "file" fields and decodes the
+// JSON reply into v.
+func (s *testServer) post(t *testing.T, path string, fields map[string]string, files []testFile, v any) {
+	t.Helper()
+	resp := s.postForm(t, path, fields, files)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		t.Fatalf("POST %s: %s: %s", path, resp.Status, b)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (s *testServer) postForm(t *testing.T, path string, fields map[string]string, files []testFile) *http.Response {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for k, val := range fields {
+		_ = mw.WriteField(k, val)
+	}
+	for _, f := range files {
+		fw, err := mw.CreateFormFile("file", f.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = io.WriteString(fw, f.content)
+	}
+	_ = mw.Close()
+	resp, err := s.client.Post(s.URL+path, mw.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func (s *testServer) get(t *testing.T, path string, header http.Header) (*http.Response, []byte) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, s.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, b
+}
+
+func (s *testServer) wait(t *testing.T, id string) JobEvent {
+	t.Helper()
+	return waitJob(t, s.store, id)
+}
+
+// waitJob waits for a job to finish and returns its final event.
+func waitJob(t *testing.T, store *JobStore, id string) JobEvent {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		ev, ok := store.Event(id)
+		if !ok {
+			t.Fatalf("job %s is gone", id)
+		}
+		if ev.Status == JobDone || ev.Status == JobFailed {
+			return ev
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("job %s did not finish", id)
+	return JobEvent{}
+}
+
+func zipNames(t *testing.T, b []byte) []string {
+	t.Helper()
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestConvertAndDownload(t *testing.T) {
+	s := newTestServer(t, &pipeline.FakeBackend{Content: []byte("converted audio")})
+	var res struct {
+		JobID       string `json:"job_id"`
+		DownloadURL string `json:"download_url"`
+	}
+	s.post(t, "/convert", map[string]string{"renditions": "mp3,wav"}, []testFile{{"song.mp3", "input"}}, &res)
+	if ev := s.wait(t, res.JobID); ev.Status != JobDone {
+		t.Fatalf("job %s: %s", ev.Status, ev.Error)
+	}
+
+	resp, body := s.get(t, "/convert/download/"+res.JobID+"/wav", nil)
+	if resp.StatusCode != http.StatusOK || string(body) != "converted audio" {
+		t.Fatalf("download: %s %q", resp.Status, body)
+	}
+	resp, body = s.get(t, "/convert/download/"+res.JobID, http.Header{"Range": {"bytes=0-8"}})
+	if resp.StatusCode != http.StatusPartialContent || string(body) != "converted" {
+		t.Fatalf("range download: %s %q", resp.Status, body)
+	}
+	resp, body = s.get(t, "/convert/download/"+res.JobID+"/all.zip", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("zip download: %s", resp.Status)
+	}
+	if got := zipNames(t, body); len(got) != 2 {
+		t.Errorf("zip holds %v, want both renditions", got)
+	}
+
+	// The signed link works without the session.
+	resp, err := http.Get(s.URL + res.DownloadURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("signed download: %s", resp.Status)
+	}
+	resp, err = http.Get(s.URL + "/convert/download/" + res.JobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("download without credentials: %s, want 404", resp.Status)
+	}
+}
+
+func TestConvertFailure(t *testing.T) {
+	s := newTestServer(t, &pipeline.FakeBackend{Err: pipeline.ErrUnsupportedInput})
+	var res struct {
+		JobID string `json:"job_id"`
+	}
+	s.post(t, "/convert", nil, []testFile{{"song.mp3", "input"}}, &res)
+	ev := s.wait(t, res.JobID)
+	if ev.Status != JobFailed || ev.ErrorCode != pipeline.CodeUnsupportedCodec {
+		t.Fatalf("job %s with code %q, want failed with %q", ev.Status, ev.ErrorCode, pipeline.CodeUnsupportedCodec)
+	}
+	if resp, _ := s.get(t, "/convert/download/"+res.JobID, nil); resp.StatusCode != http.StatusConflict {
+		t.Errorf("download of a failed job: %s, want 409", resp.Status)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	s := newTestServer(t, &pipeline.FakeBackend{})
+	var res struct {
+		BatchID string   `json:"batch_id"`
+		JobIDs  []string `json:"job_ids"`
+	}
+	s.post(t, "/convert/batch", nil, []testFile{{"one.mp3", "1"}, {"two.wav", "2"}}, &res)
+	if len(res.JobIDs) != 2 {
+		t.Fatalf("batch has jobs %v, want 2", res.JobIDs)
+	}
+	for _, id := range res.JobIDs {
+		if ev := s.wait(t, id); ev.Status != JobDone {
+			t.Fatalf("job %s: %s: %s", id, ev.Status, ev.Error)
+		}
+	}
+
+	resp, body := s.get(t, "/convert/batch/"+res.BatchID, nil)
+	var status BatchStatus
+	if err := json.Unmarshal(body, &status); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("batch status: %s %s", resp.Status, body)
+	}
+	if status.Status != JobDone {
+		t.Errorf("batch status %q, want done", status.Status)
+	}
+	resp, body = s.get(t, "/convert/batch/"+res.BatchID+"/download", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("batch download: %s", resp.Status)
+	}
+	if got := zipNames(t, body); len(got) != 2 {
+		t.Errorf("batch zip holds %v, want one output per file", got)
+	}
+}
+
+func TestAnalysisNeedsFFmpeg(t *testing.T) {
+	s := newTestServer(t, &pipeline.FakeBackend{})
+	for _, fields := range []map[string]string{
+		{"analyze": "true"},
+		{"quality": "true"},
+		{"split": "silence"},
+	} {
+		resp := s.postForm(t, "/convert", fields, []testFile{{"song.mp3", "input"}})
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%v: %s, want 400", fields, resp.Status)
+		}
+	}
+}
+
+func TestRangedDownloadsCountOnce(t *testing.T) {
+	s := newTestServer(t, &pipeline.FakeBackend{Content: []byte("converted audio")})
+	var res struct {
+		JobID string `json:"job_id"`
+	}
+	s.post(t, "/convert", map[string]string{"max_downloads": "1"}, []testFile{{"song.mp3", "input"}}, &res)
+	if ev := s.wait(t, res.JobID); ev.Status != JobDone {
+		t.Fatalf("job %s: %s", ev.Status, ev.Error)
+	}
+
+	path := "/convert/download/" + res.JobID
+	for _, r := range []string{"bytes=0-8", "bytes=0-3", "bytes=4-8"} {
+		if resp, _ := s.get(t, path, http.Header{"Range": {r}}); resp.StatusCode != http.StatusPartialContent {
+			t.Fatalf("range %s: %s, want 206", r, resp.Status)
+		}
+	}
+	// The range that reaches the end completes the download.
+	resp, body := s.get(t, path, http.Header{"Range": {"bytes=9-"}})
+	if resp.StatusCode != http.StatusPartialContent || string(body) != " audio" {
+		t.Fatalf("range to the end: %s %q", resp.Status, body)
+	}
+	if resp, _ := s.get(t, path, nil); resp.StatusCode == http.StatusOK {
+		t.Errorf("download after the limit: %s", resp.Status)
+	}
+}
+
+func TestControlAfterProcessExits(t *testing.T) {
+	store := NewJobStore()
+	job := store.Create(JobSpec{})
+	store.SetRunning(job.ID)
+	// Never signalled: the test would stop itself.
+	p, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.SetProcess(job.ID, p, 0)
+	store.ClearProcess(job.ID, p)
+	if err := store.Pause(job.ID); !errors.Is(err, errJobNotRunning) {
+		t.Errorf("pause between runs: %v, want %v", err, errJobNotRunning)
+	}
+	if err := store.SetPriority(job.ID, PriorityLow); err != nil {
+		t.Errorf("priority between runs: %v", err)
+	}
+}
+
+func TestUnwatchedQueuedJobSurvives(t *testing.T) {
+	store := NewJobStore()
+	store.abandonAfter = time.Minute
+	job := store.Create(JobSpec{})
+	abandoned := func() bool {
+		store.mu.Lock()
+		defer store.mu.Unlock()
+		return store.abandoned(job, time.Now().Add(time.Hour))
+	}
+	if abandoned() {
+		t.Error("queued job nobody listened to was abandoned")
+	}
+	_, unsubscribe, _ := store.Subscribe(job.ID)
+	unsubscribe()
+	if !abandoned() {
+		t.Error("job was not abandoned after its listener left")
+	}
+}
+
+// flakyBackend fails its first fails conversions with err.
+type flakyBackend struct {
+	pipeline.FakeBackend
+	err   error
+	fails atomic.Int32
+}
+
+func (b *flakyBackend) Convert(ctx context.Context, input string, outputs []pipeline.Output, opts pipeline.Options, stream io.Writer) error {
+	if b.fails.Add(-1) >= 0 {
+		return b.err
+	}
+	return b.FakeBackend.Convert(ctx, input, outputs, opts, stream)
+}
+
+func TestRetryPolicy(t *testing.T) {
+	t.Setenv("JOB_MAX_ATTEMPTS", "3")
+	t.Setenv("JOB_RETRY_BACKOFF", "10ms")
+	for _, tc := range []struct {
+		name     string
+		err      error
+		fails    int32
+		status   JobStatus
+		attempts int
+		retried  int
+	}{
+		{"transient", syscall.ENOSPC, 1, JobDone, 1, 1},
+		{"transient every time", syscall.ENOSPC, 10, JobFailed, 3, 2},
+		{"permanent", pipeline.ErrUnsupportedInput, 1, JobFailed, 1, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b := &flakyBackend{err: tc.err}
+			b.fails.Store(tc.fails)
+			s := newTestServer(t, b)
+			var res struct {
+				JobID string `json:"job_id"`
+			}
+			s.post(t, "/convert", nil, []testFile{{"song.mp3", "input"}}, &res)
+			if ev := s.wait(t, res.JobID); ev.Status != tc.status {
+				t.Fatalf("job %s, want %s", ev.Status, tc.status)
+			}
+			attempts := s.store.snapshot(res.JobID).Attempts
+			retried := 0
+			for _, a := range attempts {
+				if a.Retried {
+					retried++
+				}
+			}
+			if len(attempts) != tc.attempts || retried != tc.retried {
+				t.Errorf("%d failed attempts, %d retried; want %d, %d retried", len(attempts), retried, tc.attempts, tc.retried)
+			}
+		})
+	}
+}
+
+func TestPoolSharesBetweenClients(t *testing.T) {
+	p := newPool(0)
+	for range 3 {
+		p.SubmitTask(Task{Run: func() {}, Client: "heavy", Cost: 10 * time.Minute})
+	}
+	for range 3 {
+		p.SubmitTask(Task{Run: func() {}, Client: "light", Cost: time.Second})
+	}
+	var order []string
+	for range 6 {
+		task, _ := p.Take(context.Background())
+		order = append(order, task.Client)
+	}
+	want := []string{"heavy", "light", "light", "light", "heavy", "heavy"}
+	if strings.Join(order, ",") != strings.Join(want, ",") {
+		t.Errorf("tasks taken in order %v, want %v", order, want)
+	}
+}
+
+func TestPoolAgesQueuedTasks(t *testing.T) {
+	p := newPool(0)
+	low := func() Priority { return PriorityLow }
+	p.SubmitTask(Task{Run: func() {}, Client: "low", Priority: low})
+	p.SubmitTask(Task{Run: func() {}, Client: "normal"})
+	if task, _ := p.Take(context.Background()); task.Client != "normal" {
+		t.Fatalf("took %s first, want normal", task.Client)
+	}
+	p.SubmitTask(Task{Run: func() {}, Client: "normal"})
+	// The low priority task has waited long enough to outrank new ones.
+	p.mu.Lock()
+	p.queue[0].at = time.Now().Add(-2 * queueAging)
+	p.mu.Unlock()
+	if task, _ := p.Take(context.Background()); task.Client != "low" {
+		t.Errorf("took %s, want the aged low priority task", task.Client)
+	}
+}
+
+// eventIDs reads a progress stream to its end and returns the IDs of its
+// events.
+func (s *testServer) eventIDs(t *testing.T, id, lastEventID string) []uint64 {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, s.URL+"/convert/progress/"+id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var ids []uint64
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		if v, ok := strings.CutPrefix(sc.Text(), "id: "); ok {
+			n, _ := strconv.ParseUint(v, 10, 64)
+			ids = append(ids, n)
+		}
+	}
+	return ids
+}
+
+func TestProgressResumesAfterLastEventID(t *testing.T) {
+	s := newTestServer(t, &pipeline.FakeBackend{})
+	var res struct {
+		JobID string `json:"job_id"`
+	}
+	s.post(t, "/convert", nil, []testFile{{"song.mp3", "input"}}, &res)
+	s.wait(t, res.JobID)
+
+	// A running job of the same owner, whose events so far are its
+	// creation, start and progress.
+	job := s.store.Create(JobSpec{Owner: s.store.snapshot(res.JobID).Owner})
+	s.store.SetRunning(job.ID)
+	s.store.SetProgress(job.ID, pipeline.Progress{Percent: 50})
+	time.AfterFunc(100*time.Millisecond, func() { s.store.SetDone(job.ID) })
+	if got := s.eventIDs(t, job.ID, "2"); len(got) != 2 || got[0] != 3 || got[1] != 4 {
+		t.Errorf("resumed after event 2, got events %v, want [3 4]", got)
+	}
+	if got := s.eventIDs(t, job.ID, "4"); len(got) != 0 {
+		t.Errorf("resumed after the last event, got events %v, want none", got)
+	}
+	if got := s.eventIDs(t, job.ID, ""); len(got) != 1 || got[0] != 4 {
+		t.Errorf("new stream got events %v, want the current state only", got)
+	}
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+var errBadLink = errors.New("invalid or expired download link")
+
+// linkSigner issues and verifies download URLs of the form
+// /convert/download/{id}?expires=<unix>&single=1&sig=<hmac>.
+type linkSigner struct {
+	key []byte
+}
+
+// newLinkSigner keys links with DOWNLOAD_SECRET. Without it a random key is
+// used, so links stop working when the process restarts.
+func newLinkSigner() *linkSigner {
+	if s := os.Getenv("DOWNLOAD_SECRET"); s != "" {
+		return &linkSigner{key: []byte(s)}
+	}
+	log.Printf("DOWNLOAD_SECRET not set, download links will not survive a restart")
+	key := make([]byte, 32)
+	_, _ = rand.Read(key)
+	return &linkSigner{key: key}
+}
+
+func (s *linkSigner) URL(id string, expires time.Time, single bool) string {
+	q := url.Values{}
+	q.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	if single {
+		q.Set("single", "1")
+	}
+	q.Set("sig", s.mac(id, q.Get("expires"), single))
+	return "/convert/download/" + id + "?" + q.Encode()
+}
+
+// Verify checks a link's signature and expiry and reports whether it is
+// single-use, along with the signature to use as its identity.
+func (s *linkSigner) Verify(id string, q url.Values, now time.Time) (single bool, sig string, err error) {
+	exp, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err != nil {
+		return false, "", errBadLink
+	}
+	single = q.Get("single") == "1"
+	sig = q.Get("sig")
+	want := s.mac(id, q.Get("expires"), single)
+	if !hmac.Equal([]byte(sig), []byte(want)) || now.Unix() > exp {
+		return false, "", errBadLink
+	}
+	return single, sig, nil
+}
+
+func (s *linkSigner) mac(id, expires string, single bool) string {
+	m := hmac.New(sha256.New, s.key)
+	m.Write([]byte(id + "\n" + expires + "\n" + strconv.FormatBool(single)))
+	return base64.RawURLEncoding.EncodeToString(m.Sum(nil))
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"copyrem/pipeline"
+)
+
+// Split asks for a job's output to be cut into tracks, either at silent
+// gaps or at the times of an uploaded CUE sheet or chapter list.
+type Split struct {
+	Silence *pipeline.SilenceSplit
+	List    *pipeline.TrackList
+}
+
+// parseSplit reads split=silence, with optional silence_threshold (dB) and
+// silence_gap (seconds), or a "tracks" file holding a CUE sheet or chapter
+// list. It returns nil when no split is requested.
+func parseSplit(r *http.Request) (*Split, error) {
+	mode := r.FormValue("split")
+	if r.MultipartForm != nil && len(r.MultipartForm.File["tracks"]) > 0 {
+		if mode != "" && mode != "tracks" {
+			return nil, fmt.Errorf("a tracks file needs split=tracks")
+		}
+		mode = "tracks"
+	}
+	switch mode {
+	case "":
+		return nil, nil
+	case "silence":
+		s := pipeline.DefaultSilenceSplit()
+		if v := r.FormValue("silence_threshold"); v != "" {
+			f, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(v), "dB"), 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid silence_threshold: %q", v)
+			}
+			s.ThresholdDB = f
+		}
+		if v := r.FormValue("silence_gap"); v != "" {
+			d, err := parseSeconds(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid silence_gap: %q", v)
+			}
+			s.MinGap = d
+		}
+		return &Split{Silence: &s}, nil
+	case "tracks":
+		f, _, err := r.FormFile("tracks")
+		if err != nil {
+			return nil, fmt.Errorf("split=tracks needs a tracks file")
+		}
+		defer f.Close()
+		list, err := pipeline.ParseTrackList(f)
+		if err != nil {
+			return nil, err
+		}
+		return &Split{List: &list}, nil
+	}
+	return nil, fmt.Errorf("unknown split %q", mode)
+}
+
+// newTrackOutputs lays out one output per track and rendition, named
+// "01 - Title.ext" and grouped in a folder per rendition when there are
+// several.
+func newTrackOutputs(dir string, list pipeline.TrackList, renditions []pipeline.Rendition) []JobOutput {
+	width := max(2, len(strconv.Itoa(len(list.Tracks))))
+	var outs []JobOutput
+	for i, t := range list.Tracks {
+		title := t.Title
+		if title == "" {
+			title = fmt.Sprintf("Track %d", i+1)
+		}
+		title = strings.ReplaceAll(title, "/", "-")
+		name := fmt.Sprintf("%0*d - %s", width, i+1, safeDownloadFilename(title))
+		for _, r := range renditions {
+			filename := name + r.Ext()
+			if len(renditions) > 1 {
+				filename = r.Name + "/" + filename
+			}
+			outs = append(outs, JobOutput{
+				Rendition: r,
+				Track:     i + 1,
+				Path:      filepath.Join(dir, randHex(8)+r.Ext()),
+				Filename:  filename,
+			})
+		}
+	}
+	return outs
+}
+
+// SetTracks records the tracks found in a silence split job and replaces
+// its outputs, one per rendition until then, with per-track outputs.
+func (s *JobStore) SetTracks(id string, list pipeline.TrackList) {
+	s.update(id, func(j *Job) {
+		var renditions []pipeline.Rendition
+		for _, o := range j.Outputs {
+			renditions = append(renditions, o.Rendition)
+		}
+		j.Tracks = &list
+		j.Outputs = newTrackOutputs(filepath.Dir(j.InPath), list, renditions)
+	})
+}
+
+// trackOutputs groups a split job's outputs by track.
+func trackOutputs(j *Job) [][]pipeline.Output {
+	outs := make([][]pipeline.Output, len(j.Tracks.Tracks))
+	for _, o := range j.Outputs {
+		outs[o.Track-1] = append(outs[o.Track-1], pipeline.Output{Rendition: o.Rendition, Path: o.Path})
+	}
+	return outs
+}
+
+// checkInput probes the upload once to validate the requested segment or
+// track list against its duration, so a bad range fails the request rather
+// than the job.
+func checkInput(inPath string, opts pipeline.Options, split *Split) error {
+	if opts.Segment.IsZero() && (split == nil || split.List == nil) {
+		return nil
+	}
+	dur, err := pipeline.Duration(inPath, opts)
+	if err != nil {
+		return err
+	}
+	if split != nil && split.List != nil {
+		return split.List.Check(dur)
+	}
+	return opts.Segment.Check(dur)
+}
+
+type TrackRecord struct {
+	Number    int     `json:"number"`
+	Title     string  `json:"title,omitempty"`
+	Performer string  `json:"performer,omitempty"`
+	Start     float64 `json:"start"`
+	End       float64 `json:"end,omitempty"`
+}
+
+func trackRecords(list *pipeline.TrackList) []TrackRecord {
+	if list == nil {
+		return nil
+	}
+	recs := make([]TrackRecord, len(list.Tracks))
+	for i, t := range list.Tracks {
+		recs[i] = TrackRecord{
+			Number:    i + 1,
+			Title:     t.Title,
+			Performer: t.Performer,
+			Start:     roundSeconds(t.Start),
+			End:       roundSeconds(t.End),
+		}
+	}
+	return recs
+}
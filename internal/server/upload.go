@@ -1,23 +1,37 @@
 package server
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
+
+	"copyrem/pipeline"
 )
 
 const (
 	MaxUploadMB    = 80
+	MaxRenditions  = 6
 	DownloadSuffix = "_modified.mp3"
 )
 
 var (
-	AllowedExtensions    = []string{".mp3", ".m4a", ".wav", ".flac", ".aac", ".ogg"}
+	// VideoExtensions are the accepted video containers; their audio is
+	// processed and can be muxed back with the video copied.
+	VideoExtensions      = pipeline.VideoContainers()
+	AllowedExtensions    = append([]string{".mp3", ".m4a", ".wav", ".flac", ".aac", ".ogg"}, VideoExtensions...)
 	allowedExtensionsStr = strings.Join(AllowedExtensions, ", ")
 )
 
+func isVideo(ext string) bool {
+	return slices.Contains(VideoExtensions, strings.ToLower(ext))
+}
+
 func allowedExtension(ext string) bool {
 	for _, e := range AllowedExtensions {
 		if ext == e {
@@ -27,6 +41,15 @@ func allowedExtension(ext string) bool {
 	return false
 }
 
+type Upload struct {
+	Path     string
+	BaseName string
+	// RelDir is the upload's folder within a batch archive, "" otherwise.
+	RelDir string
+	Size   int64
+	SHA256 string
+}
+
 type uploadError struct {
 	status int
 	err    error
@@ -36,43 +59,61 @@ func (e uploadError) Error() string { return e.err.Error() }
 
 func (e uploadError) Status() int { return e.status }
 
-func ParseUpload(w http.ResponseWriter, r *http.Request) (inPath, baseName string, err error) {
-	limit := int64(MaxUploadMB) * 1024 * 1024
-	r.Body = http.MaxBytesReader(w, r.Body, limit)
-	if err := r.ParseMultipartForm(2 << 20); err != nil {
-		if err.Error() == "http: request body too large" {
-			return "", "", uploadError{http.StatusRequestEntityTooLarge, fmt.Errorf("file too large (max %d MB)", MaxUploadMB)}
-		}
-		return "", "", uploadError{http.StatusBadRequest, fmt.Errorf("invalid form")}
+// ParseUpload saves the uploaded file to a temp file, hashing it on the way.
+func ParseUpload(w http.ResponseWriter, r *http.Request) (*Upload, error) {
+	if err := parseMultipart(w, r, MaxUploadMB); err != nil {
+		return nil, err
 	}
 	fhs, ok := r.MultipartForm.File["file"]
 	if !ok || len(fhs) == 0 {
-		return "", "", uploadError{http.StatusBadRequest, fmt.Errorf("missing file")}
+		return nil, uploadError{http.StatusBadRequest, fmt.Errorf("missing file")}
 	}
 	fh := fhs[0]
 	ext := strings.ToLower(filepath.Ext(fh.Filename))
 	if !allowedExtension(ext) {
-		return "", "", uploadError{http.StatusBadRequest, fmt.Errorf("unsupported format. Allowed: %s", allowedExtensionsStr)}
+		return nil, uploadError{http.StatusBadRequest, fmt.Errorf("unsupported format. Allowed: %s", allowedExtensionsStr)}
 	}
 	inF, err := fh.Open()
 	if err != nil {
-		return "", "", uploadError{http.StatusInternalServerError, fmt.Errorf("failed to read upload")}
+		return nil, uploadError{http.StatusInternalServerError, fmt.Errorf("failed to read upload")}
 	}
 	defer inF.Close()
-	dir := os.TempDir()
-	inPath = filepath.Join(dir, "copyrem-"+randHex(8)+ext)
+	return saveUpload(inF, fh.Filename)
+}
+
+func parseMultipart(w http.ResponseWriter, r *http.Request, maxMB int) error {
+	r.Body = http.MaxBytesReader(w, r.Body, int64(maxMB)*1024*1024)
+	if err := r.ParseMultipartForm(2 << 20); err != nil {
+		if err.Error() == "http: request body too large" {
+			return uploadError{http.StatusRequestEntityTooLarge, fmt.Errorf("file too large (max %d MB)", maxMB)}
+		}
+		return uploadError{http.StatusBadRequest, fmt.Errorf("invalid form")}
+	}
+	return nil
+}
+
+// saveUpload copies src to a temp file named after the upload's extension,
+// hashing it on the way.
+func saveUpload(src io.Reader, filename string) (*Upload, error) {
+	ext := strings.ToLower(filepath.Ext(filename))
+	inPath := filepath.Join(os.TempDir(), "copyrem-"+randHex(8)+ext)
 	dst, err := os.Create(inPath)
 	if err != nil {
-		return "", "", uploadError{http.StatusInternalServerError, fmt.Errorf("failed to create temp file")}
+		return nil, uploadError{http.StatusInternalServerError, fmt.Errorf("failed to create temp file")}
 	}
-	_, err = dst.ReadFrom(inF)
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(dst, h), src)
 	dst.Close()
 	if err != nil {
 		_ = os.Remove(inPath)
-		return "", "", uploadError{http.StatusInternalServerError, fmt.Errorf("failed to save upload")}
+		return nil, uploadError{http.StatusInternalServerError, fmt.Errorf("failed to save upload")}
 	}
-	baseName = safeDownloadFilename(strings.TrimSuffix(fh.Filename, filepath.Ext(fh.Filename)))
-	return inPath, baseName, nil
+	return &Upload{
+		Path:     inPath,
+		BaseName: safeDownloadFilename(strings.TrimSuffix(filename, filepath.Ext(filename))),
+		Size:     n,
+		SHA256:   hex.EncodeToString(h.Sum(nil)),
+	}, nil
 }
 
 func uploadStatus(err error) int {
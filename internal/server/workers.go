@@ -0,0 +1,181 @@
+package server
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"time"
+
+	"copyrem/pipeline"
+)
+
+const (
+	// taskOverhead is charged for every task on top of its cost, so clients
+	// take turns even when costs are unknown.
+	taskOverhead = 10 * time.Second
+	// queueAging raises the priority of a queued task by one level for every
+	// period it waits, so low priority work isn't starved.
+	queueAging = 2 * time.Minute
+)
+
+// Task is work queued on a Pool.
+type Task struct {
+	Run func()
+	// Client identifies who queued the task. Clients take turns.
+	Client string
+	// Priority is read whenever the pool picks a task, so changes apply to
+	// queued tasks. Nil means normal.
+	Priority func() Priority
+	// Cost estimates the work, such as the length of the input. Each client
+	// is charged the cost of its tasks, and the least charged goes next.
+	Cost time.Duration
+	// Job and Opts describe the job Run converts, for remote workers that
+	// take the task instead of running it.
+	Job  *Job
+	Opts pipeline.Options
+}
+
+// Pool runs queued tasks on a fixed number of workers. It picks the task
+// with the highest priority, then the one whose client has been charged
+// least, then the oldest.
+type Pool struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	queue []queuedTask
+	// served is what each client with queued tasks has been charged, on
+	// the scale of clock, the charge of the last client picked.
+	served map[string]time.Duration
+	clock  time.Duration
+}
+
+type queuedTask struct {
+	Task
+	at time.Time
+}
+
+// NewPool starts n workers. WORKERS overrides n when set.
+func NewPool(n int) *Pool {
+	return startPool(envInt("WORKERS", n))
+}
+
+// NewPreviewPool starts the fast lane previews run on, so they don't wait
+// behind queued jobs. PREVIEW_WORKERS sets its size (default 2).
+func NewPreviewPool() *Pool {
+	return startPool(envInt("PREVIEW_WORKERS", 2))
+}
+
+// NewRemotePool queues jobs for remote workers to take. WORKERS sets how
+// many run locally as well (default none).
+func NewRemotePool() *Pool {
+	return newPool(envInt("WORKERS", 0))
+}
+
+func startPool(n int) *Pool {
+	if n <= 0 {
+		n = runtime.NumCPU()
+	}
+	return newPool(n)
+}
+
+func newPool(n int) *Pool {
+	p := &Pool{served: make(map[string]time.Duration)}
+	p.cond = sync.NewCond(&p.mu)
+	for range n {
+		go p.work()
+	}
+	return p
+}
+
+// Submit queues task at normal priority for an anonymous client.
+func (p *Pool) Submit(task func()) {
+	p.SubmitTask(Task{Run: task})
+}
+
+func (p *Pool) SubmitTask(t Task) {
+	p.mu.Lock()
+	// A client that comes back starts level with the others rather than
+	// with credit for the time it was away.
+	if !p.queued(t.Client) {
+		p.served[t.Client] = max(p.served[t.Client], p.clock)
+	}
+	p.queue = append(p.queue, queuedTask{Task: t, at: time.Now()})
+	p.mu.Unlock()
+	p.cond.Signal()
+}
+
+func (p *Pool) work() {
+	for {
+		t, _ := p.Take(context.Background())
+		t.Run()
+	}
+}
+
+// Take waits for the next task and removes it from the queue, for running
+// elsewhere. It returns false if ctx ends first.
+func (p *Pool) Take(ctx context.Context) (Task, bool) {
+	stop := context.AfterFunc(ctx, func() {
+		p.mu.Lock()
+		p.cond.Broadcast()
+		p.mu.Unlock()
+	})
+	defer stop()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for len(p.queue) == 0 {
+		if ctx.Err() != nil {
+			return Task{}, false
+		}
+		p.cond.Wait()
+	}
+	return p.next(), true
+}
+
+// next removes the task to run next from the queue and charges its client.
+// Callers must hold p.mu.
+func (p *Pool) next() Task {
+	now := time.Now()
+	best := 0
+	bestPrio := p.queue[0].priority(now)
+	for i := 1; i < len(p.queue); i++ {
+		t := p.queue[i]
+		prio := t.priority(now)
+		if prio > bestPrio || prio == bestPrio && p.served[t.Client] < p.served[p.queue[best].Client] {
+			best, bestPrio = i, prio
+		}
+	}
+	t := p.queue[best].Task
+	p.queue = append(p.queue[:best], p.queue[best+1:]...)
+	p.clock = p.served[t.Client]
+	p.served[t.Client] += t.Cost + taskOverhead
+	waiting := make(map[string]bool, len(p.served))
+	for _, q := range p.queue {
+		waiting[q.Client] = true
+	}
+	for c, s := range p.served {
+		if s <= p.clock && !waiting[c] {
+			delete(p.served, c)
+		}
+	}
+	return t
+}
+
+// queued reports whether client has tasks in the queue. Callers must hold
+// p.mu.
+func (p *Pool) queued(client string) bool {
+	for _, t := range p.queue {
+		if t.Client == client {
+			return true
+		}
+	}
+	return false
+}
+
+// priority is the task's priority, raised for the time it has waited.
+func (t queuedTask) priority(now time.Time) Priority {
+	prio := PriorityNormal
+	if t.Priority != nil {
+		prio = t.Priority()
+	}
+	prio += Priority(now.Sub(t.at) / queueAging)
+	return min(prio, PriorityHigh)
+}
@@ -0,0 +1,221 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const wsPingEvery = 30 * time.Second
+
+// wsRequest is a control message from the client. Actions: subscribe,
+// unsubscribe, cancel, pause, resume and priority (with Priority set).
+type wsRequest struct {
+	Action   string `json:"action"`
+	JobID    string `json:"job_id"`
+	Priority string `json:"priority,omitempty"`
+}
+
+type wsReply struct {
+	Type   string `json:"type"`
+	Action string `json:"action,omitempty"`
+	JobID  string `json:"job_id"`
+	Error  string `json:"error,omitempty"`
+	Code   string `json:"code,omitempty"`
+}
+
+type wsEvent struct {
+	Type  string `json:"type"`
+	JobID string `json:"job_id"`
+	Event string `json:"event"`
+	Seq   uint64 `json:"seq"`
+	JobEvent
+}
+
+// WebSocketHandler serves /convert/ws, which multiplexes any number of jobs
+// over one connection, and /convert/ws/{id}, which subscribes to one job
+// up front.
+func WebSocketHandler(store *JobStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		owner, ok := jobOwner(w, r)
+		if !ok {
+			return
+		}
+		id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/convert/ws"), "/")
+		if id != "" && !store.Owns(id, owner) {
+			writeError(w, http.StatusNotFound, "job not found")
+			return
+		}
+
+		conn := upgradeWebSocket(w, r)
+		if conn == nil {
+			return
+		}
+		sess := &wsSession{conn: conn, store: store, owner: owner, subs: make(map[string]chan struct{}), done: make(chan struct{})}
+		defer sess.close()
+		go sess.keepalive()
+
+		if id != "" {
+			sess.subscribe(id)
+		}
+		for {
+			msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			sess.handle(msg)
+		}
+	}
+}
+
+type wsSession struct {
+	conn  *wsConn
+	store *JobStore
+	owner string
+	mu    sync.Mutex
+	subs  map[string]chan struct{}
+	done  chan struct{}
+}
+
+func (s *wsSession) handle(msg []byte) {
+	var req wsRequest
+	if err := json.Unmarshal(msg, &req); err != nil {
+		s.reply(req, errInvalidMessage)
+		return
+	}
+	if req.JobID == "" || !s.store.Owns(req.JobID, s.owner) {
+		s.reply(req, errJobNotFound)
+		return
+	}
+	var err error
+	switch req.Action {
+	case "subscribe":
+		err = s.subscribe(req.JobID)
+	case "unsubscribe":
+		s.unsubscribe(req.JobID)
+	case "cancel":
+		s.store.Cancel(req.JobID)
+	case "pause":
+		err = s.store.Pause(req.JobID)
+	case "resume":
+		err = s.store.Resume(req.JobID)
+	case "priority":
+		var p Priority
+		if p, err = ParsePriority(req.Priority); err == nil {
+			err = s.store.SetPriority(req.JobID, p)
+		}
+	default:
+		err = errUnknownAction
+	}
+	s.reply(req, err)
+}
+
+func (s *wsSession) reply(req wsRequest, err error) {
+	rep := wsReply{Type: "ack", Action: req.Action, JobID: req.JobID}
+	if err != nil {
+		rep.Type = "error"
+		rep.Error, rep.Code = err.Error(), wsErrorCode(err)
+	}
+	_ = s.conn.WriteJSON(rep)
+}
+
+func (s *wsSession) subscribe(id string) error {
+	changes, unsubscribe, ok := s.store.Subscribe(id)
+	if !ok {
+		return errJobNotFound
+	}
+	stop := make(chan struct{})
+	s.mu.Lock()
+	if old, ok := s.subs[id]; ok {
+		close(old)
+	}
+	s.subs[id] = stop
+	s.mu.Unlock()
+
+	go func() {
+		defer unsubscribe()
+		var lastID uint64
+		for {
+			ev, ok := s.store.Event(id)
+			if !ok {
+				_ = s.conn.WriteJSON(wsReply{Type: "error", JobID: id, Error: errJobNotFound.Error(), Code: wsErrorCode(errJobNotFound)})
+				return
+			}
+			if ev.ID > lastID {
+				lastID = ev.ID
+				if err := s.conn.WriteJSON(wsEvent{Type: "event", JobID: id, Event: ev.Type(), Seq: ev.ID, JobEvent: ev}); err != nil {
+					return
+				}
+			}
+			if ev.Terminal() {
+				s.forget(id, stop)
+				return
+			}
+			select {
+			case <-changes:
+			case <-stop:
+				return
+			case <-s.done:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (s *wsSession) unsubscribe(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if stop, ok := s.subs[id]; ok {
+		close(stop)
+		delete(s.subs, id)
+	}
+}
+
+// forget drops a finished subscription unless it has been replaced.
+func (s *wsSession) forget(id string, stop chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.subs[id] == stop {
+		delete(s.subs, id)
+	}
+}
+
+func (s *wsSession) keepalive() {
+	t := time.NewTicker(wsPingEvery)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-t.C:
+			if err := s.conn.Ping(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *wsSession) close() {
+	close(s.done)
+	s.conn.Close()
+}
+
+// wsErrorCode is the code of an error replying to a request, matching what
+// writeError would give it.
+func wsErrorCode(err error) string {
+	switch {
+	case errors.Is(err, errJobNotFound):
+		return statusCodes[http.StatusNotFound]
+	case errors.Is(err, errJobNotRunning), errors.Is(err, errJobNotPaused):
+		return statusCodes[http.StatusConflict]
+	}
+	return statusCodes[http.StatusBadRequest]
+}
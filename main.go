@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"copyrem/internal/config"
@@ -12,6 +15,10 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "worker" {
+		runWorker()
+		return
+	}
 	cfg, err := config.Load("settings.json")
 	if err != nil {
 		log.Printf("settings.json not found, using defaults")
@@ -35,6 +42,20 @@ func main() {
 	}
 }
 
+// runWorker converts jobs for the coordinator at COORDINATOR_URL until it
+// is interrupted.
+func runWorker() {
+	wk, err := server.NewWorker()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "worker: %v\n", err)
+		os.Exit(1)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	log.Printf("CopyRem worker %s taking jobs from %s", wk.Name, wk.URL)
+	wk.Run(ctx)
+}
+
 func defaultAddr() string {
 	if p := os.Getenv("PORT"); p != "" {
 		return ":" + p
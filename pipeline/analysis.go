@@ -0,0 +1,182 @@
+package pipeline
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+
+	"copyrem/internal/ffmpeg"
+)
+
+const (
+	// WaveformSampleRate is the rate audio is decoded at for peaks; it is
+	// the sample_rate of every Waveform.
+	WaveformSampleRate = 22050
+
+	MaxWaveformLength  = 1 << 20
+	MaxSpectrogramSize = 4096
+)
+
+// Waveform holds min/max peak pairs in the JSON layout of audiowaveform,
+// which peaks.js and wavesurfer.js load directly.
+type Waveform struct {
+	Version         int   `json:"version"`
+	Channels        int   `json:"channels"`
+	SampleRate      int   `json:"sample_rate"`
+	SamplesPerPixel int   `json:"samples_per_pixel"`
+	Bits            int   `json:"bits"`
+	Length          int   `json:"length"`
+	Data            []int `json:"data"`
+}
+
+// WaveformOptions sets the resolution of a waveform, either directly with
+// SamplesPerPixel or as a number of Pixels across the whole input. Bits is
+// 8 or 16.
+type WaveformOptions struct {
+	SamplesPerPixel int
+	Pixels          int
+	Bits            int
+}
+
+func DefaultWaveformOptions() WaveformOptions {
+	return WaveformOptions{SamplesPerPixel: 256, Bits: 8}
+}
+
+func (w WaveformOptions) validate() error {
+	if w.Bits != 8 && w.Bits != 16 {
+		return invalid("bits must be 8 or 16")
+	}
+	if w.SamplesPerPixel < 0 || w.Pixels < 0 || (w.SamplesPerPixel == 0 && w.Pixels == 0) {
+		return invalid("samples_per_pixel or pixels must be positive")
+	}
+	if w.Pixels > MaxWaveformLength {
+		return invalid(fmt.Sprintf("at most %d pixels", MaxWaveformLength))
+	}
+	return nil
+}
+
+// Peaks decodes the first audio stream of input, mixed down to mono, and
+// returns its waveform.
+func Peaks(ctx context.Context, input string, opts Options, w WaveformOptions) (*Waveform, error) {
+	if err := w.validate(); err != nil {
+		return nil, err
+	}
+	if err := opts.checkAnalysis("compute waveforms"); err != nil {
+		return nil, err
+	}
+	binary, err := resolveBinary(opts.Binary)
+	if err != nil {
+		return nil, err
+	}
+	spp := w.SamplesPerPixel
+	if spp == 0 {
+		dur, err := ffmpeg.Duration(binary, input)
+		if err != nil {
+			return nil, probeError(err)
+		}
+		spp = max(1, int(math.Ceil(dur.Seconds()*WaveformSampleRate/float64(w.Pixels))))
+	}
+
+	var wf *Waveform
+	_, err = decode(ctx, opts.Limits, binary, []string{"-v", "error", "-i", input,
+		"-map", "0:a:0", "-ac", "1", "-ar", fmt.Sprint(WaveformSampleRate), "-f", "s16le", "-c:a", "pcm_s16le", "pipe:1"},
+		func(r io.Reader) (err error) {
+			wf, err = readPeaks(r, spp, w.Bits)
+			return err
+		})
+	if err != nil {
+		return nil, err
+	}
+	return wf, nil
+}
+
+// readPeaks reduces 16-bit little-endian mono samples to min/max pairs of
+// spp samples each.
+func readPeaks(r io.Reader, spp, bits int) (*Waveform, error) {
+	wf := &Waveform{Version: 2, Channels: 1, SampleRate: WaveformSampleRate, SamplesPerPixel: spp, Bits: bits}
+	br := bufio.NewReaderSize(r, 64<<10)
+	var buf [2]byte
+	lo, hi, n := math.MaxInt16, math.MinInt16, 0
+	flush := func() {
+		if bits == 8 {
+			lo, hi = lo>>8, hi>>8
+		}
+		wf.Data = append(wf.Data, lo, hi)
+		wf.Length++
+		lo, hi, n = math.MaxInt16, math.MinInt16, 0
+	}
+	for {
+		if _, err := io.ReadFull(br, buf[:]); err != nil {
+			break
+		}
+		s := int(int16(binary.LittleEndian.Uint16(buf[:])))
+		lo, hi = min(lo, s), max(hi, s)
+		if n++; n == spp {
+			flush()
+			if wf.Length > MaxWaveformLength {
+				return nil, invalid(fmt.Sprintf("waveform longer than %d pixels", MaxWaveformLength))
+			}
+		}
+	}
+	if n > 0 {
+		flush()
+	}
+	if wf.Data == nil {
+		wf.Data = []int{}
+	}
+	return wf, nil
+}
+
+// SpectrogramOptions sets the size of a spectrogram image and whether it
+// has axes and a colour legend.
+type SpectrogramOptions struct {
+	Width  int
+	Height int
+	Legend bool
+}
+
+func DefaultSpectrogramOptions() SpectrogramOptions {
+	return SpectrogramOptions{Width: 1024, Height: 512}
+}
+
+func (s SpectrogramOptions) validate() error {
+	if s.Width < 64 || s.Height < 64 || s.Width > MaxSpectrogramSize || s.Height > MaxSpectrogramSize {
+		return invalid(fmt.Sprintf("spectrogram size must be between 64 and %d", MaxSpectrogramSize))
+	}
+	return nil
+}
+
+// Spectrogram renders the first audio stream of input as a PNG at output.
+func Spectrogram(ctx context.Context, input, output string, opts Options, s SpectrogramOptions) error {
+	if err := s.validate(); err != nil {
+		return err
+	}
+	if err := opts.checkAnalysis("draw spectrograms"); err != nil {
+		return err
+	}
+	binary, err := resolveBinary(opts.Binary)
+	if err != nil {
+		return err
+	}
+	legend := 0
+	if s.Legend {
+		legend = 1
+	}
+	graph := fmt.Sprintf("[0:a:0]showspectrumpic=s=%dx%d:legend=%d", s.Width, s.Height, legend)
+	cmd := opts.Limits.command(ctx, binary, "-v", "error", "-y", "-i", input,
+		"-filter_complex", graph, "-frames:v", "1", "-f", "image2", "-c:v", "png", output)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := opts.Limits.run(cmd); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return &Error{Op: "ffmpeg", Err: err, Stderr: strings.TrimSpace(stderr.String())}
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Backend runs the processing chain. convert validates the options and
+// checks the outputs against Capabilities before calling Convert.
+type Backend interface {
+	// Name identifies the backend in configuration.
+	Name() string
+	Capabilities() Capabilities
+	// Probe returns the duration of the audio file at input.
+	Probe(input string, opts Options) (time.Duration, error)
+	// Convert processes input into outputs. With a stream, the only output
+	// is written to it instead of its path, and opts.OnProgress is nil.
+	Convert(ctx context.Context, input string, outputs []Output, opts Options, stream io.Writer) error
+	// Version identifies the build that Convert runs, for cache keys.
+	Version(opts Options) (string, error)
+}
+
+// Capabilities describes what a backend can write.
+type Capabilities struct {
+	// Formats lists the output formats it encodes.
+	Formats []string
+	// Video reports whether it can mux audio back into a copied video.
+	Video bool
+	// MaxChannels is the most output channels it makes; zero means any.
+	MaxChannels int
+	// Analysis reports whether DetectTracks, Peaks, Spectrogram, Measure
+	// and Compare work with it. They run ffmpeg, so they are only offered
+	// by backends that have it anyway.
+	Analysis bool
+}
+
+// checkAnalysis rejects analyses with backends that can't run them; what
+// is the analysis, for the error.
+func (o Options) checkAnalysis(what string) error {
+	if b := o.backend(); !b.Capabilities().Analysis {
+		return invalid(fmt.Sprintf("the %s backend cannot %s", b.Name(), what))
+	}
+	return nil
+}
+
+func (c Capabilities) check(name string, outputs []Output, opts Options) error {
+	for _, o := range outputs {
+		if !slices.Contains(c.Formats, o.Rendition.Format) {
+			return invalid(fmt.Sprintf("the %s backend cannot write %s", name, o.Rendition.Format))
+		}
+		if o.Rendition.IsVideo() && !c.Video {
+			return invalid(fmt.Sprintf("the %s backend cannot write video", name))
+		}
+	}
+	if c.MaxChannels > 0 && opts.Params.Channels > c.MaxChannels {
+		return invalid(fmt.Sprintf("the %s backend makes at most %d channels", name, c.MaxChannels))
+	}
+	return nil
+}
+
+var (
+	// FFmpeg runs every conversion through ffmpeg.
+	FFmpeg Backend = ffmpegBackend{}
+	// Native processes WAV input to WAV outputs in Go, without ffmpeg.
+	Native Backend = nativeBackend{}
+	// Auto writes the WAV outputs of inputs Native can read with Native and
+	// everything else with FFmpeg.
+	Auto Backend = autoBackend{}
+)
+
+var (
+	backendsMu sync.RWMutex
+	backends   = map[string]Backend{}
+)
+
+func init() {
+	for _, b := range []Backend{FFmpeg, Native, Auto} {
+		RegisterBackend(b)
+	}
+}
+
+// RegisterBackend makes b available to LookupBackend under its name,
+// replacing any backend registered with the same name.
+func RegisterBackend(b Backend) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	backends[b.Name()] = b
+}
+
+// LookupBackend returns the backend registered as name; empty means FFmpeg.
+func LookupBackend(name string) (Backend, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		return FFmpeg, nil
+	}
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+	b, ok := backends[name]
+	if !ok {
+		return nil, invalid(fmt.Sprintf("unknown backend %q", name))
+	}
+	return b, nil
+}
+
+// Backends lists the names of the registered backends.
+func Backends() []string {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (o Options) backend() Backend {
+	if o.Backend == nil {
+		return FFmpeg
+	}
+	return o.Backend
+}
+
+type ffmpegBackend struct{}
+
+func (ffmpegBackend) Name() string { return "ffmpeg" }
+
+func (ffmpegBackend) Capabilities() Capabilities {
+	return Capabilities{Formats: Formats(), Video: true, Analysis: true}
+}
+
+func (ffmpegBackend) Version(opts Options) (string, error) {
+	return ffmpegVersion(opts.Binary)
+}
+
+// FakeBackend is a Backend for tests that does no processing, so they run
+// without ffmpeg. It isn't registered; tests set it in Options.Backend.
+// Every probe reports Duration, ten seconds when zero, and every output gets
+// Content, "FAKE" when nil. Progress is reported as for a real conversion.
+// When Err is set, Convert fails with it.
+type FakeBackend struct {
+	Duration time.Duration
+	Content  []byte
+	Err      error
+}
+
+func (*FakeBackend) Name() string { return "fake" }
+
+func (*FakeBackend) Capabilities() Capabilities {
+	return Capabilities{Formats: Formats(), Video: true}
+}
+
+func (*FakeBackend) Version(Options) (string, error) { return "fake", nil }
+
+func (f *FakeBackend) Probe(string, Options) (time.Duration, error) {
+	if f.Duration == 0 {
+		return 10 * time.Second, nil
+	}
+	return f.Duration, nil
+}
+
+func (f *FakeBackend) Convert(ctx context.Context, input string, outputs []Output, opts Options, stream io.Writer) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if f.Err != nil {
+		return f.Err
+	}
+	duration, _ := f.Probe(input, opts)
+	if !opts.Segment.IsZero() {
+		if err := opts.Segment.Check(duration); err != nil {
+			return err
+		}
+	}
+	total := opts.Segment.Length(duration)
+	if opts.OnProgress != nil {
+		opts.OnProgress(Progress{Stage: StageProbing})
+		opts.OnProgress(Progress{Stage: StageEncoding, Percent: 50, Processed: total / 2, Total: total})
+	}
+	content := f.Content
+	if content == nil {
+		content = []byte("FAKE")
+	}
+	var size int64
+	for _, o := range outputs {
+		if stream != nil {
+			if _, err := stream.Write(content); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := os.WriteFile(o.Path, content, 0o644); err != nil {
+			return err
+		}
+		size += int64(len(content))
+	}
+	if opts.OnProgress != nil {
+		opts.OnProgress(Progress{Stage: StageEncoding, Percent: 100, Processed: total, Total: total, OutputSize: size, Done: true})
+	}
+	return nil
+}
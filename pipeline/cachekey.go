@@ -0,0 +1,56 @@
+package pipeline
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+
+	"copyrem/internal/ffmpeg"
+)
+
+var versions sync.Map // binary path -> version string
+
+// CacheKey identifies one rendition of converting an input, given its
+// SHA-256 digest, with opts. It covers the exact ffmpeg arguments and the
+// ffmpeg build, or the native backend's version, so equal keys mean
+// interchangeable outputs.
+func CacheKey(inputSHA256 string, opts Options, r Rendition) (string, error) {
+	if err := opts.Validate(); err != nil {
+		return "", err
+	}
+	if err := r.validate(); err != nil {
+		return "", err
+	}
+	version, err := opts.backend().Version(opts)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	h.Write([]byte(inputSHA256 + "\x00" + version + "\x00"))
+	h.Write([]byte(filterChain(opts.Params, opts.Intensity) + "\x00"))
+	if !opts.Segment.IsZero() {
+		// The segment filters depend only on the segment and the input.
+		fmt.Fprintf(h, "%+v\x00", opts.Segment)
+	}
+	h.Write([]byte(strings.Join(metadataArgs(opts.Metadata), "\x00") + "\x00"))
+	h.Write([]byte(strings.Join(r.encoderArgs(opts.Params), "\x00")))
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func ffmpegVersion(binary string) (string, error) {
+	binary, err := resolveBinary(binary)
+	if err != nil {
+		return "", err
+	}
+	version, ok := versions.Load(binary)
+	if !ok {
+		v, err := ffmpeg.Version(binary)
+		if err != nil {
+			return "", err
+		}
+		version, _ = versions.LoadOrStore(binary, v)
+	}
+	return version.(string), nil
+}
@@ -0,0 +1,312 @@
+package pipeline
+
+import (
+	"math"
+	"math/cmplx"
+)
+
+// The DSP below mirrors the ffmpeg filters the chain uses, for the native
+// backend. It works on whole signals held in memory.
+
+const (
+	// resampleTaps is the length of each side of the resampling filter, in
+	// samples at the lower of the two rates, and resampleCutoff its
+	// passband as a share of that rate's Nyquist frequency; resampleBeta
+	// shapes its Kaiser window. They match swresample's defaults.
+	resampleTaps   = 16
+	resampleCutoff = 0.97
+	resampleBeta   = 9
+	// resamplePhases is how finely the filter is tabulated between taps.
+	resamplePhases = 512
+)
+
+// resample converts x from rate in to rate out with a windowed-sinc filter,
+// like aresample. The rates need not be integers, so resampling from a
+// relabelled rate also covers asetrate.
+func resample(x []float32, in, out float64) []float32 {
+	if in == out || len(x) == 0 {
+		return x
+	}
+	ratio := out / in
+	cutoff := resampleCutoff * min(1, ratio)
+	half := int(math.Ceil(resampleTaps / min(1, ratio)))
+	table := sincTable(half, cutoff)
+	y := make([]float32, int(math.Round(float64(len(x))*ratio)))
+	for i := range y {
+		t := float64(i) / ratio
+		c := int(t)
+		f := (t - float64(c)) * resamplePhases
+		// Every tap on one side of t is the same fraction of a step away
+		// from a table entry, so walk the table a whole tap at a time.
+		var sum float64
+		jl := int(f)
+		fl := f - float64(jl)
+		for m := 0; m < half && c-m >= 0; m++ {
+			j := m*resamplePhases + jl
+			sum += float64(x[c-m]) * (table[j] + fl*(table[j+1]-table[j]))
+		}
+		jr := int(resamplePhases - f)
+		fr := resamplePhases - f - float64(jr)
+		for m := 1; m <= half && c+m < len(x); m++ {
+			j := (m-1)*resamplePhases + jr
+			sum += float64(x[c+m]) * (table[j] + fr*(table[j+1]-table[j]))
+		}
+		y[i] = float32(sum)
+	}
+	return y
+}
+
+// resample converts every channel from rate in to rate out.
+func (a *pcmAudio) resample(in float64, out int) *pcmAudio {
+	res := &pcmAudio{rate: out, ch: make([][]float32, len(a.ch))}
+	for c, ch := range a.ch {
+		res.ch[c] = resample(ch, in, float64(out))
+	}
+	return res
+}
+
+// sincTable tabulates a Kaiser-windowed sinc lowpass, scaled to unity gain,
+// from 0 to half taps away at resamplePhases steps per tap.
+func sincTable(half int, cutoff float64) []float64 {
+	table := make([]float64, half*resamplePhases+2)
+	i0beta := besselI0(resampleBeta)
+	for j := range table {
+		d := float64(j) / resamplePhases
+		if d >= float64(half) {
+			break
+		}
+		r := d / float64(half)
+		w := besselI0(resampleBeta*math.Sqrt(1-r*r)) / i0beta
+		s := 1.0
+		if d > 0 {
+			s = math.Sin(math.Pi*cutoff*d) / (math.Pi * cutoff * d)
+		}
+		table[j] = cutoff * s * w
+	}
+	return table
+}
+
+// besselI0 is the zeroth-order modified Bessel function of the first kind.
+func besselI0(x float64) float64 {
+	sum, term := 1.0, 1.0
+	for k := 1; term > 1e-12*sum; k++ {
+		f := x / (2 * float64(k))
+		term *= f * f
+		sum += term
+	}
+	return sum
+}
+
+// stretch changes the duration of a by 1/tempo without changing its pitch,
+// like atempo: windows of the input are overlap-added at a fixed output hop,
+// each taken from near its nominal position where it best continues the
+// previous one. All channels share the alignment, found on their mix.
+func stretch(a *pcmAudio, tempo float64) *pcmAudio {
+	n := a.frames()
+	if tempo == 1 || n == 0 {
+		return a
+	}
+	frame := nextPow2(a.rate / 24)
+	hop := frame / 2
+	tol := hop / 2
+	window := make([]float64, frame)
+	for i := range window {
+		window[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(frame))
+	}
+	mono := a.mix()
+	corr := newCorrelator(hop + 2*tol + hop)
+
+	outLen := int(math.Round(float64(n) / tempo))
+	out := make([][]float64, len(a.ch))
+	for c := range out {
+		out[c] = make([]float64, outLen+frame)
+	}
+	weight := make([]float64, outLen+frame)
+	prev := 0
+	for k := 0; k*hop < outLen; k++ {
+		pos := 0
+		if k > 0 {
+			nominal := int(math.Round(float64(k*hop) * tempo))
+			pos = nominal
+			lo, hi := max(nominal-tol, 0), min(nominal+tol, n-hop)
+			if next := prev + hop; hi > lo && next+hop <= n {
+				pos = lo + corr.best(mono[next:next+hop], mono[lo:hi+hop])
+			}
+		}
+		at := k * hop
+		for i, w := range window {
+			if pos+i >= n {
+				break
+			}
+			if pos+i < 0 {
+				continue
+			}
+			for c := range out {
+				out[c][at+i] += w * float64(a.ch[c][pos+i])
+			}
+			weight[at+i] += w
+		}
+		prev = pos
+	}
+
+	res := &pcmAudio{rate: a.rate, ch: make([][]float32, len(a.ch))}
+	for c := range out {
+		ch := make([]float32, outLen)
+		for i := range ch {
+			if weight[i] > 1e-6 {
+				ch[i] = float32(out[c][i] / weight[i])
+			}
+		}
+		res.ch[c] = ch
+	}
+	return res
+}
+
+// correlator finds where a template best matches within a longer signal,
+// by FFT cross-correlation.
+type correlator struct {
+	plan fftPlan
+	a, b []complex128
+}
+
+// newCorrelator makes a correlator for templates and regions whose lengths
+// add up to at most n.
+func newCorrelator(n int) *correlator {
+	size := nextPow2(n)
+	return &correlator{plan: newFFTPlan(size), a: make([]complex128, size), b: make([]complex128, size)}
+}
+
+// best returns the offset into region at which tmpl correlates best.
+func (c *correlator) best(tmpl, region []float32) int {
+	clear(c.a)
+	clear(c.b)
+	for i, v := range tmpl {
+		c.a[i] = complex(float64(v), 0)
+	}
+	for i, v := range region {
+		c.b[i] = complex(float64(v), 0)
+	}
+	c.plan.transform(c.a)
+	c.plan.transform(c.b)
+	// The real part of the transform of A·conj(B) is the correlation.
+	for i := range c.a {
+		c.a[i] *= cmplx.Conj(c.b[i])
+	}
+	c.plan.transform(c.a)
+	best, at := math.Inf(-1), 0
+	for d := 0; d <= len(region)-len(tmpl); d++ {
+		if v := real(c.a[d]); v > best {
+			best, at = v, d
+		}
+	}
+	return at
+}
+
+// mix averages the channels of a.
+func (a *pcmAudio) mix() []float32 {
+	if len(a.ch) == 1 {
+		return a.ch[0]
+	}
+	m := make([]float32, a.frames())
+	for _, ch := range a.ch {
+		for i, v := range ch {
+			m[i] += v / float32(len(a.ch))
+		}
+	}
+	return m
+}
+
+// withChannels converts mono or stereo audio to n channels, as -ac does for
+// those layouts: mixing down averages and mixing up copies.
+func (a *pcmAudio) withChannels(n int) *pcmAudio {
+	switch {
+	case len(a.ch) == n:
+		return a
+	case n == 1:
+		return &pcmAudio{rate: a.rate, ch: [][]float32{a.mix()}}
+	default:
+		res := &pcmAudio{rate: a.rate, ch: make([][]float32, n)}
+		for c := range res.ch {
+			res.ch[c] = a.ch[min(c, len(a.ch)-1)]
+		}
+		return res
+	}
+}
+
+// delay prepends the given number of silent samples to each channel and
+// pads the others to the same length, like adelay. Channels past the end of
+// delays are not delayed.
+func (a *pcmAudio) delay(delays ...int) *pcmAudio {
+	longest := 0
+	for c := range a.ch {
+		if c < len(delays) {
+			longest = max(longest, delays[c])
+		}
+	}
+	if longest == 0 {
+		return a
+	}
+	res := &pcmAudio{rate: a.rate, ch: make([][]float32, len(a.ch))}
+	for c, ch := range a.ch {
+		d := 0
+		if c < len(delays) {
+			d = delays[c]
+		}
+		out := make([]float32, len(ch)+longest)
+		copy(out[d:], ch)
+		res.ch[c] = out
+	}
+	return res
+}
+
+// slice keeps frames from start up to end.
+func (a *pcmAudio) slice(start, end int) *pcmAudio {
+	start, end = min(max(start, 0), a.frames()), min(max(end, 0), a.frames())
+	end = max(start, end)
+	res := &pcmAudio{rate: a.rate, ch: make([][]float32, len(a.ch))}
+	for c, ch := range a.ch {
+		res.ch[c] = ch[start:end]
+	}
+	return res
+}
+
+func (a *pcmAudio) at(d float64) int {
+	return int(math.Round(d * float64(a.rate)))
+}
+
+// fade ramps the first (in) or last n frames linearly, like afade's
+// default curve.
+func (a *pcmAudio) fade(n int, in bool) {
+	n = min(n, a.frames())
+	for _, ch := range a.ch {
+		for i := range n {
+			g := float32(i) / float32(n)
+			if in {
+				ch[i] *= g
+			} else {
+				ch[len(ch)-1-i] *= g
+			}
+		}
+	}
+}
+
+// trimSilence drops frames at the head and tail in which every channel is
+// below threshold (linear).
+func (a *pcmAudio) trimSilence(threshold float32) *pcmAudio {
+	loud := func(i int) bool {
+		for _, ch := range a.ch {
+			if ch[i] > threshold || ch[i] < -threshold {
+				return true
+			}
+		}
+		return false
+	}
+	start, end := 0, a.frames()
+	for start < end && !loud(start) {
+		start++
+	}
+	for end > start && !loud(end-1) {
+		end--
+	}
+	return a.slice(start, end)
+}
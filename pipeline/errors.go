@@ -0,0 +1,174 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"syscall"
+)
+
+var (
+	ErrInvalidOptions = errors.New("invalid options")
+	ErrBinaryNotFound = errors.New("ffmpeg binary not found")
+	// ErrTimeout reports a conversion stopped for exceeding Limits.
+	ErrTimeout = errors.New("processing timed out")
+	// ErrTooLong and ErrUnsupportedInput report inputs a backend won't
+	// take: longer than it processes, or in a format it can't read.
+	ErrTooLong          = errors.New("input too long")
+	ErrUnsupportedInput = errors.New("unsupported input")
+)
+
+// Error reports a failure of one of the external tools the pipeline runs.
+// Stderr holds the tool's diagnostic output, if any.
+type Error struct {
+	Op     string
+	Err    error
+	Stderr string
+}
+
+func (e *Error) Error() string {
+	if e.Stderr != "" {
+		return fmt.Sprintf("%s: %v (stderr: %s)", e.Op, e.Err, e.Stderr)
+	}
+	return fmt.Sprintf("%s: %v", e.Op, e.Err)
+}
+
+func (e *Error) Unwrap() error { return e.Err }
+
+func invalid(msg string) error {
+	return fmt.Errorf("%w: %s", ErrInvalidOptions, msg)
+}
+
+// Code is a stable, machine-readable reason for a failure.
+type Code string
+
+const (
+	CodeInvalidOptions   Code = "invalid_options"
+	CodeUnsupportedCodec Code = "unsupported_codec"
+	CodeCorruptInput     Code = "corrupt_input"
+	CodeNoAudioStream    Code = "no_audio_stream"
+	CodeTooLong          Code = "too_long"
+	CodeTimeout          Code = "timeout"
+	CodeResourceLimit    Code = "resource_limit"
+	CodeInternal         Code = "internal"
+)
+
+// ErrorCode classifies an error from the pipeline. It returns "" for nil,
+// for cancellation and for errors that didn't come from the pipeline. Other
+// errors can classify themselves with a Code method, as *Error does.
+func ErrorCode(err error) Code {
+	var e interface{ Code() Code }
+	switch {
+	case err == nil || errors.Is(err, context.Canceled):
+		return ""
+	case errors.Is(err, ErrTimeout):
+		return CodeTimeout
+	case errors.Is(err, ErrTooLong):
+		return CodeTooLong
+	case errors.Is(err, ErrUnsupportedInput):
+		return CodeUnsupportedCodec
+	case errors.Is(err, ErrInvalidOptions):
+		return CodeInvalidOptions
+	case errors.Is(err, ErrBinaryNotFound):
+		return CodeInternal
+	case errors.As(err, &e):
+		return e.Code()
+	}
+	return ""
+}
+
+// stderrCodes maps fragments of ffmpeg's and ffprobe's messages, and of
+// how a process ended, to the failures they point to. Earlier entries win.
+var stderrCodes = []struct {
+	code      Code
+	fragments []string
+}{
+	{CodeNoAudioStream, []string{
+		"matches no streams",
+		"does not contain any stream",
+		"no audio stream",
+	}},
+	{CodeUnsupportedCodec, []string{
+		"decoder (codec",
+		"unsupported codec",
+		"codec not currently supported",
+		"could not find codec parameters",
+		"not yet implemented",
+	}},
+	{CodeCorruptInput, []string{
+		"invalid data found when processing input",
+		"moov atom not found",
+		"header missing",
+		"error while decoding",
+		"invalid frame",
+		"corrupt",
+		"truncat",
+		"end of file",
+		"could not find sync",
+	}},
+	// Checked before transientFragments: a process killed by its own
+	// limits would be killed again on a retry.
+	{CodeResourceLimit, []string{
+		"file size limit exceeded",
+		"cannot allocate memory",
+		"cpu time limit exceeded",
+	}},
+}
+
+// Code classifies the failure from the tool's stderr and how it exited.
+func (e *Error) Code() Code {
+	text := strings.ToLower(e.Stderr)
+	if e.Err != nil {
+		text += "\n" + strings.ToLower(e.Err.Error())
+	}
+	for _, c := range stderrCodes {
+		for _, f := range c.fragments {
+			if strings.Contains(text, f) {
+				return c.code
+			}
+		}
+	}
+	// Probing fails on inputs that aren't media at all.
+	if e.Op == "probe" || e.Op == "native decode" {
+		return CodeCorruptInput
+	}
+	return CodeInternal
+}
+
+// transientFragments point to the machine running out of something rather
+// than to the input: a full disk, or ffmpeg killed by the OOM killer.
+var transientFragments = []string{
+	"no space left on device",
+	"signal: killed",
+	"resource temporarily unavailable",
+	"too many open files",
+}
+
+// Transient reports whether err came from a condition of the machine that
+// may have passed by the time the conversion is tried again. Errors with a
+// Transient method decide for themselves.
+func Transient(err error) bool {
+	var t interface{ Transient() bool }
+	if errors.As(err, &t) {
+		return t.Transient()
+	}
+	switch ErrorCode(err) {
+	case "", CodeInternal:
+	default:
+		return false
+	}
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EMFILE) {
+		return true
+	}
+	text := strings.ToLower(err.Error())
+	for _, f := range transientFragments {
+		if strings.Contains(text, f) {
+			return true
+		}
+	}
+	return false
+}
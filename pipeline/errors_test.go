@@ -0,0 +1,24 @@
+package pipeline
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestLimitKillsAreNotRetried(t *testing.T) {
+	for _, err := range []error{
+		&Error{Op: "ffmpeg", Err: errors.New("signal: file size limit exceeded")},
+		&Error{Op: "ffmpeg", Err: errors.New("signal: killed: cpu time limit exceeded")},
+		&Error{Op: "ffmpeg", Err: errors.New("exit status 1"), Stderr: "Error: Cannot allocate memory"},
+	} {
+		if code := ErrorCode(err); code != CodeResourceLimit {
+			t.Errorf("%v: code %q, want %q", err, code, CodeResourceLimit)
+		}
+		if Transient(err) {
+			t.Errorf("%v: transient", err)
+		}
+	}
+	if err := (&Error{Op: "ffmpeg", Err: errors.New("signal: killed")}); !Transient(err) {
+		t.Errorf("%v: not transient", err)
+	}
+}
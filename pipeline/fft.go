@@ -0,0 +1,50 @@
+package pipeline
+
+import (
+	"math"
+	"math/bits"
+)
+
+// fftPlan holds the twiddle factors of a radix-2 FFT of one size.
+type fftPlan []complex128
+
+func newFFTPlan(n int) fftPlan {
+	p := make(fftPlan, n/2)
+	for k := range p {
+		s, c := math.Sincos(-2 * math.Pi * float64(k) / float64(n))
+		p[k] = complex(c, s)
+	}
+	return p
+}
+
+// transform computes the discrete Fourier transform of x in place. len(x)
+// must be the plan's size, a power of two.
+func (p fftPlan) transform(x []complex128) {
+	n := len(x)
+	if n < 2 {
+		return
+	}
+	shift := bits.UintSize - bits.Len(uint(n-1))
+	for i := range x {
+		if j := int(bits.Reverse(uint(i)) >> shift); i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+	for size := 2; size <= n; size <<= 1 {
+		half, stride := size/2, n/size
+		for start := 0; start < n; start += size {
+			for k := range half {
+				u, v := x[start+k], x[start+k+half]*p[k*stride]
+				x[start+k], x[start+k+half] = u+v, u-v
+			}
+		}
+	}
+}
+
+// nextPow2 returns the smallest power of two that is at least n.
+func nextPow2(n int) int {
+	if n <= 1 {
+		return 1
+	}
+	return 1 << bits.Len(uint(n-1))
+}
@@ -0,0 +1,113 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"slices"
+	"time"
+
+	"copyrem/internal/ffmpeg"
+)
+
+// Limits constrain the time and resources a conversion may use. The zero
+// value imposes none.
+type Limits struct {
+	// Timeout and TimeoutPerMinute bound the wall-clock time of a
+	// conversion: Timeout plus TimeoutPerMinute for every minute of the
+	// selected input.
+	Timeout          time.Duration
+	TimeoutPerMinute time.Duration
+	// Memory caps the address space of each ffmpeg process, FileSize the
+	// size of each file it writes, both in bytes, and CPU its processor
+	// time. They are set on Linux only, before ffmpeg starts, by running
+	// it through the current executable, which must link this package.
+	Memory   int64
+	FileSize int64
+	CPU      time.Duration
+	// Nice is the niceness ffmpeg processes run at, on Linux.
+	Nice int
+	// Dir is the working directory of ffmpeg processes.
+	Dir string
+}
+
+func (l Limits) timeout(input time.Duration) time.Duration {
+	return l.Timeout + time.Duration(float64(l.TimeoutPerMinute)*input.Minutes())
+}
+
+// withTimeout cancels ctx with ErrTimeout after t, leaving out the time
+// paused reports.
+func withTimeout(ctx context.Context, t time.Duration, paused func() time.Duration) (context.Context, context.CancelFunc) {
+	if paused == nil {
+		return context.WithTimeoutCause(ctx, t, ErrTimeout)
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	start := time.Now()
+	go func() {
+		timer := time.NewTimer(t)
+		defer timer.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-timer.C:
+			}
+			if left := t - (time.Since(start) - paused()); left > 0 {
+				timer.Reset(left)
+				continue
+			}
+			cancel(ErrTimeout)
+			return
+		}
+	}()
+	return ctx, func() { cancel(context.Canceled) }
+}
+
+// sandboxArgs start every ffmpeg run: it never reads the terminal, and its
+// input, the only one each run has, can only be a local file in one of the
+// formats ffmpeg.Demuxers names.
+var sandboxArgs = []string{"-nostdin", "-protocol_whitelist", "file", "-format_whitelist", ffmpeg.Demuxers}
+
+// command prepares an ffmpeg run under the limits.
+func (l Limits) command(ctx context.Context, binary string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, binary, append(slices.Clone(sandboxArgs), args...)...)
+	cmd.Dir = l.Dir
+	return cmd
+}
+
+// start starts cmd under the limits and sets its niceness.
+func (l Limits) start(cmd *exec.Cmd) error {
+	l.wrap(cmd)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	if err := l.renice(cmd.Process.Pid); err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return fmt.Errorf("set niceness: %w", err)
+	}
+	return nil
+}
+
+// run starts cmd under the limits and waits for it.
+func (l Limits) run(cmd *exec.Cmd) error {
+	if err := l.start(cmd); err != nil {
+		return err
+	}
+	return l.wait(cmd)
+}
+
+// wait waits for cmd. A process that used up its CPU limit is killed by
+// the kernel with SIGKILL, which looks like any other kill, so its error
+// says which limit it hit. The time the process is charged can fall short
+// of the kernel's count by a scheduler tick, hence the slack.
+func (l Limits) wait(cmd *exec.Cmd) error {
+	err := cmd.Wait()
+	if err == nil || l.CPU < time.Second || cmd.ProcessState == nil {
+		return err
+	}
+	if ps := cmd.ProcessState; ps.UserTime()+ps.SystemTime()+50*time.Millisecond >= l.CPU.Truncate(time.Second) {
+		return fmt.Errorf("%w: cpu time limit exceeded", err)
+	}
+	return err
+}
@@ -0,0 +1,67 @@
+//go:build linux
+
+package pipeline
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+// limitedExec is the argv[0] a process is re-run with to set resource
+// limits on itself before it executes ffmpeg. Its arguments are the memory,
+// file size and CPU limits, then the binary and its arguments.
+const limitedExec = "copyrem-limited-exec"
+
+func init() {
+	if len(os.Args) > 4 && os.Args[0] == limitedExec {
+		err := execLimited(os.Args[1:])
+		fmt.Fprintf(os.Stderr, "apply limits: %v\n", err)
+		os.Exit(126)
+	}
+}
+
+// wrap makes cmd start the current executable, which sets the resource
+// limits on itself and then executes the binary, so that they hold from
+// ffmpeg's first instruction.
+func (l Limits) wrap(cmd *exec.Cmd) {
+	if l.Memory <= 0 && l.FileSize <= 0 && l.CPU <= 0 {
+		return
+	}
+	cmd.Args = append([]string{limitedExec,
+		strconv.FormatInt(l.Memory, 10),
+		strconv.FormatInt(l.FileSize, 10),
+		strconv.FormatInt(int64(l.CPU.Seconds()), 10),
+		cmd.Path,
+	}, cmd.Args[1:]...)
+	cmd.Path = "/proc/self/exe"
+}
+
+// execLimited sets the limits wrap passes and executes the binary. It only
+// returns on failure.
+func execLimited(args []string) error {
+	for i, resource := range []int{syscall.RLIMIT_AS, syscall.RLIMIT_FSIZE, syscall.RLIMIT_CPU} {
+		v, err := strconv.ParseInt(args[i], 10, 64)
+		if err != nil {
+			return err
+		}
+		if v <= 0 {
+			continue
+		}
+		if err := syscall.Setrlimit(resource, &syscall.Rlimit{Cur: uint64(v), Max: uint64(v)}); err != nil {
+			return err
+		}
+	}
+	binary := args[3]
+	return syscall.Exec(binary, append([]string{binary}, args[4:]...), os.Environ())
+}
+
+// renice sets the niceness of the started process pid.
+func (l Limits) renice(pid int) error {
+	if l.Nice == 0 {
+		return nil
+	}
+	return syscall.Setpriority(syscall.PRIO_PROCESS, pid, l.Nice)
+}
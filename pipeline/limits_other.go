@@ -0,0 +1,11 @@
+//go:build !linux
+
+package pipeline
+
+import "os/exec"
+
+// wrap and renice do nothing: resource limits and niceness are only set on
+// Linux.
+func (l Limits) wrap(cmd *exec.Cmd) {}
+
+func (l Limits) renice(pid int) error { return nil }
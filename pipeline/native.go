@@ -0,0 +1,266 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"time"
+)
+
+// nativeVersion stands in for the ffmpeg version in the cache keys of
+// native outputs; bump it when the native DSP changes.
+const nativeVersion = "copyrem-native 1"
+
+// nativeMaxDuration caps the inputs the native backend takes, since it
+// holds every stage of the signal in memory.
+const nativeMaxDuration = 5 * time.Minute
+
+// nativeMaxRate is the highest sample rate the native backend reads, which
+// with nativeMaxDuration bounds the samples it holds.
+const nativeMaxRate = 192000
+
+// silenceLevel is silenceThreshold as a linear amplitude.
+var silenceLevel = float32(math.Pow(10, -50.0/20))
+
+// nativeOutput reports whether the native backend can write o.
+func nativeOutput(o Output) bool {
+	return o.Rendition.Format == "wav" && !o.Rendition.IsVideo()
+}
+
+// nativeInput checks that the native backend can read input.
+func nativeInput(input string) error {
+	f, d, err := wavFileFormat(input)
+	switch {
+	case err != nil:
+		return fmt.Errorf("%w: the native backend only reads WAV", ErrUnsupportedInput)
+	case !f.supported():
+		return fmt.Errorf("%w: the native backend cannot read WAV format %d with %d bits", ErrUnsupportedInput, f.tag, f.bits)
+	case f.channels > 2:
+		return fmt.Errorf("%w: the native backend reads mono and stereo only", ErrUnsupportedInput)
+	case f.rate > nativeMaxRate:
+		return fmt.Errorf("%w: the native backend reads sample rates up to %d Hz", ErrUnsupportedInput, nativeMaxRate)
+	case d > nativeMaxDuration:
+		return fmt.Errorf("%w: the native backend takes inputs up to %s", ErrTooLong, nativeMaxDuration)
+	}
+	return nil
+}
+
+type nativeBackend struct{}
+
+func (nativeBackend) Name() string { return "native" }
+
+func (nativeBackend) Capabilities() Capabilities {
+	return Capabilities{Formats: []string{"wav"}, MaxChannels: 2}
+}
+
+func (nativeBackend) Version(Options) (string, error) { return nativeVersion, nil }
+
+// Probe reads the duration from the WAV header.
+func (nativeBackend) Probe(input string, opts Options) (time.Duration, error) {
+	_, d, err := wavFileFormat(input)
+	if err != nil {
+		return 0, &Error{Op: "probe", Err: err}
+	}
+	return d, nil
+}
+
+func (nativeBackend) Convert(ctx context.Context, input string, outputs []Output, opts Options, stream io.Writer) error {
+	if err := nativeInput(input); err != nil {
+		return err
+	}
+	_, err := convertNative(ctx, input, outputs, opts, stream, opts.OnProgress)
+	return err
+}
+
+type autoBackend struct{}
+
+func (autoBackend) Name() string { return "auto" }
+
+func (autoBackend) Capabilities() Capabilities { return FFmpeg.Capabilities() }
+
+// Version covers both backends: which one writes a rendition depends only
+// on the input and the rendition, so the pair fixes the output.
+func (autoBackend) Version(opts Options) (string, error) {
+	v, err := FFmpeg.Version(opts)
+	if errors.Is(err, ErrBinaryNotFound) {
+		v, err = "none", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return nativeVersion + "/" + v, nil
+}
+
+func (autoBackend) Probe(input string, opts Options) (time.Duration, error) {
+	if _, d, err := wavFileFormat(input); err == nil {
+		return d, nil
+	}
+	return FFmpeg.Probe(input, opts)
+}
+
+func (autoBackend) Convert(ctx context.Context, input string, outputs []Output, opts Options, stream io.Writer) error {
+	var native, rest []Output
+	if nativeInput(input) == nil {
+		for _, o := range outputs {
+			if nativeOutput(o) {
+				native = append(native, o)
+			} else {
+				rest = append(rest, o)
+			}
+		}
+	} else {
+		rest = outputs
+	}
+	if len(native) == 0 {
+		return FFmpeg.Convert(ctx, input, rest, opts, stream)
+	}
+	if len(rest) == 0 {
+		_, err := convertNative(ctx, input, native, opts, stream, opts.OnProgress)
+		return err
+	}
+	// ffmpeg reports progress for the rest; count the native outputs in
+	// its final size.
+	size, err := convertNative(ctx, input, native, opts, nil, nil)
+	if err != nil {
+		return err
+	}
+	if next := opts.OnProgress; next != nil {
+		opts.OnProgress = func(p Progress) {
+			if p.Done {
+				p.OutputSize += size
+			}
+			next(p)
+		}
+	}
+	return FFmpeg.Convert(ctx, input, rest, opts, stream)
+}
+
+// convertNative runs the processing chain in Go on a WAV input and writes
+// WAV outputs, or the only output to stream. It returns the total size of
+// the files written.
+func convertNative(ctx context.Context, input string, outputs []Output, opts Options, stream io.Writer, onProgress func(Progress)) (int64, error) {
+	if onProgress != nil {
+		onProgress(Progress{Stage: StageProbing})
+	}
+	f, err := os.Open(input)
+	if err != nil {
+		return 0, fmt.Errorf("open input: %w", err)
+	}
+	a, err := readWAV(f, nativeMaxDuration)
+	f.Close()
+	if err != nil {
+		return 0, &Error{Op: "native decode", Err: err}
+	}
+	seg := opts.Segment
+	if !seg.IsZero() {
+		if err := seg.Check(a.duration()); err != nil {
+			return 0, err
+		}
+	}
+	total := seg.Length(a.duration())
+	report := func(percent int) {
+		if onProgress != nil {
+			processed := total * time.Duration(percent) / 100
+			onProgress(Progress{Stage: StageEncoding, Percent: percent, Processed: processed, Total: total})
+		}
+	}
+
+	a = seg.apply(a)
+	stages := nativeChain(opts.Params, opts.Intensity)
+	for i, stage := range stages {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		a = stage(a)
+		// Leave the last step for writing the outputs.
+		report(100 * (i + 1) / (len(stages) + 1))
+	}
+
+	var size int64
+	for _, o := range outputs {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		if stream != nil {
+			if err := writeWAV(stream, a, opts.Metadata); err != nil {
+				return 0, &Error{Op: "native encode", Err: err}
+			}
+			continue
+		}
+		n, err := writeWAVFile(o.Path, a, opts.Metadata)
+		if err != nil {
+			return 0, &Error{Op: "native encode", Err: err}
+		}
+		size += n
+	}
+	if onProgress != nil {
+		onProgress(Progress{Stage: StageEncoding, Percent: 100, Processed: total, Total: total, OutputSize: size, Done: true})
+	}
+	return size, nil
+}
+
+func writeWAVFile(path string, a *pcmAudio, tags map[string]string) (int64, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	err = writeWAV(f, a, tags)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return 0, err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// apply cuts and fades a as the segment filters do.
+func (s Segment) apply(a *pcmAudio) *pcmAudio {
+	end := a.frames()
+	if s.End > 0 {
+		end = a.at(s.End.Seconds())
+	}
+	a = a.slice(a.at(s.Start.Seconds()), end)
+	if s.TrimSilence {
+		a = a.trimSilence(silenceLevel)
+	}
+	if s.FadeIn > 0 {
+		a.fade(a.at(s.FadeIn.Seconds()), true)
+	}
+	if s.FadeOut > 0 {
+		a.fade(a.at(s.FadeOut.Seconds()), false)
+	}
+	return a
+}
+
+// nativeChain returns the stages of filterChain, followed by the channel
+// conversion the encoder does, as functions on decoded audio.
+func nativeChain(cfg Params, intensity float64) []func(*pcmAudio) *pcmAudio {
+	sr := cfg.SampleRate
+	p := math.Pow(2, (cfg.PitchSemitones*intensity)/12)
+	tf := tempoFactor(cfg, intensity)
+	stages := []func(*pcmAudio) *pcmAudio{
+		// asetrate relabels the samples as sr*p whatever their rate.
+		func(a *pcmAudio) *pcmAudio { return a.resample(float64(sr)*p, sr) },
+		func(a *pcmAudio) *pcmAudio { return stretch(a, 1/p) },
+		func(a *pcmAudio) *pcmAudio { return stretch(a, tf) },
+	}
+	for _, r := range append(cfg.ResampleRates[:len(cfg.ResampleRates):len(cfg.ResampleRates)], sr) {
+		stages = append(stages, func(a *pcmAudio) *pcmAudio { return a.resample(float64(a.rate), r) })
+	}
+	delayL := int(float64(cfg.DelayLeftMs) * intensity)
+	delayR := int(float64(cfg.DelayRightMs) * intensity)
+	return append(stages,
+		func(a *pcmAudio) *pcmAudio {
+			return a.delay(a.at(float64(delayL)/1000), a.at(float64(delayR)/1000))
+		},
+		func(a *pcmAudio) *pcmAudio { return a.withChannels(cfg.Channels) },
+	)
+}
@@ -0,0 +1,131 @@
+package pipeline
+
+import (
+	"context"
+	"math"
+	"math/cmplx"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestNativeMatchesFFmpeg converts synthetic signals with both backends and
+// checks that the outputs agree in length, level and pitch. The two resample
+// and stretch differently, so the samples themselves aren't compared.
+func TestNativeMatchesFFmpeg(t *testing.T) {
+	if _, err := resolveBinary(""); err != nil {
+		t.Skip("ffmpeg not found")
+	}
+	rendition, err := ParseRendition("wav")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signals := []struct {
+		name  string
+		rate  int
+		tones [][]float64 // frequencies per channel
+	}{
+		{"mono", 44100, [][]float64{{440}}},
+		{"stereo", 48000, [][]float64{{440}, {1000}}},
+		{"chord", 44100, [][]float64{{220, 3000}, {660}}},
+	}
+	for _, sig := range signals {
+		t.Run(sig.name, func(t *testing.T) {
+			dir := t.TempDir()
+			input := filepath.Join(dir, "in.wav")
+			writeTones(t, input, sig.rate, sig.tones)
+
+			var outs [2]*pcmAudio
+			for i, backend := range []Backend{Native, FFmpeg} {
+				out := Output{Rendition: rendition, Path: filepath.Join(dir, backend.Name()+".wav")}
+				opts := DefaultOptions()
+				opts.Backend = backend
+				if err := ConvertOutputs(context.Background(), input, []Output{out}, opts); err != nil {
+					t.Fatalf("%s: %v", backend.Name(), err)
+				}
+				outs[i] = readWAVFile(t, out.Path)
+			}
+			native, ff := outs[0], outs[1]
+
+			if native.rate != ff.rate || len(native.ch) != len(ff.ch) {
+				t.Fatalf("native is %d Hz with %d channels, ffmpeg %d Hz with %d", native.rate, len(native.ch), ff.rate, len(ff.ch))
+			}
+			if d := math.Abs(native.duration().Seconds() - ff.duration().Seconds()); d > 0.05 {
+				t.Errorf("lengths differ by %.3fs: native %s, ffmpeg %s", d, native.duration(), ff.duration())
+			}
+			for c := range native.ch {
+				if d := math.Abs(rmsDB(native.ch[c]) - rmsDB(ff.ch[c])); d > 1 {
+					t.Errorf("channel %d: levels differ by %.2f dB", c, d)
+				}
+				nf, ffreq := peakFrequency(native.ch[c], native.rate), peakFrequency(ff.ch[c], ff.rate)
+				if math.Abs(nf-ffreq)/ffreq > 0.01 {
+					t.Errorf("channel %d: peak at %.1f Hz, ffmpeg's at %.1f Hz", c, nf, ffreq)
+				}
+			}
+		})
+	}
+}
+
+// writeTones writes two seconds of 16-bit WAV with a sum of sines on each
+// channel.
+func writeTones(t *testing.T, path string, rate int, tones [][]float64) {
+	t.Helper()
+	a := &pcmAudio{rate: rate, ch: make([][]float32, len(tones))}
+	for c, freqs := range tones {
+		a.ch[c] = make([]float32, 2*rate)
+		for i := range a.ch[c] {
+			var v float64
+			for _, f := range freqs {
+				v += 0.5 / float64(len(freqs)) * math.Sin(2*math.Pi*f*float64(i)/float64(rate))
+			}
+			a.ch[c][i] = float32(v)
+		}
+	}
+	if _, err := writeWAVFile(path, a, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readWAVFile(t *testing.T, path string) *pcmAudio {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	a, err := readWAV(f, nativeMaxDuration)
+	if err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	return a
+}
+
+func rmsDB(x []float32) float64 {
+	var sum float64
+	for _, v := range x {
+		sum += float64(v) * float64(v)
+	}
+	return 10 * math.Log10(sum/float64(len(x)))
+}
+
+// peakFrequency finds the strongest frequency in the middle of x.
+func peakFrequency(x []float32, rate int) float64 {
+	n := 1 << 15
+	for n > len(x) {
+		n >>= 1
+	}
+	start := (len(x) - n) / 2
+	buf := make([]complex128, n)
+	for i := range buf {
+		w := 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(n-1))
+		buf[i] = complex(float64(x[start+i])*w, 0)
+	}
+	newFFTPlan(n).transform(buf)
+	best := 1
+	for k := 2; k < n/2; k++ {
+		if cmplx.Abs(buf[k]) > cmplx.Abs(buf[best]) {
+			best = k
+		}
+	}
+	return float64(best) * float64(rate) / float64(n)
+}
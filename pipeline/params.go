@@ -0,0 +1,49 @@
+package pipeline
+
+type Params struct {
+	Bitrate        string  `json:"bitrate"`
+	SampleRate     int     `json:"sample_rate"`
+	Channels       int     `json:"channels"`
+	TempoFactor    float64 `json:"tempo_factor"`
+	PitchSemitones float64 `json:"pitch_semitones"`
+	ResampleRates  []int   `json:"resample_rates"`
+	DelayLeftMs    int     `json:"delay_left_ms"`
+	DelayRightMs   int     `json:"delay_right_ms"`
+}
+
+func DefaultParams() Params {
+	return Params{
+		Bitrate:        "320k",
+		SampleRate:     44100,
+		Channels:       2,
+		TempoFactor:    0.90,
+		PitchSemitones: 0.25,
+		ResampleRates:  []int{48000, 96000, 48000},
+		DelayLeftMs:    1,
+		DelayRightMs:   8,
+	}
+}
+
+func (p Params) validate() error {
+	if p.Bitrate == "" {
+		return invalid("bitrate is required")
+	}
+	if p.SampleRate <= 0 {
+		return invalid("sample_rate must be positive")
+	}
+	if p.Channels <= 0 {
+		return invalid("channels must be positive")
+	}
+	if p.TempoFactor <= 0 {
+		return invalid("tempo_factor must be positive")
+	}
+	for _, r := range p.ResampleRates {
+		if r <= 0 {
+			return invalid("resample_rates must be positive")
+		}
+	}
+	if p.DelayLeftMs < 0 || p.DelayRightMs < 0 {
+		return invalid("delays must not be negative")
+	}
+	return nil
+}
@@ -0,0 +1,405 @@
+// Package pipeline converts audio through the CopyRem processing chain.
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"copyrem/internal/ffmpeg"
+)
+
+const (
+	MinIntensity = 0.0
+	MaxIntensity = 4.0
+
+	progressMinStep     = 2
+	progressMinInterval = 200 * time.Millisecond
+)
+
+type Options struct {
+	Params    Params
+	Intensity float64
+	// Segment limits processing to part of the input, with optional fades.
+	Segment Segment
+	// Metadata holds tags, such as title or track, written to every output.
+	Metadata map[string]string
+	// Binary is the ffmpeg executable to run. When empty it is looked up in
+	// PATH and in a bin directory next to the executable or working directory.
+	Binary string
+	// OnProgress, when set, receives progress updates with non-decreasing
+	// percentages. The last update of a successful conversion has Done set.
+	OnProgress func(Progress)
+	// OnStart, when set, receives the ffmpeg process once it has started so
+	// callers can suspend it or adjust its scheduling priority.
+	OnStart func(*os.Process)
+	// OnExit, when set, receives the process from OnStart once it has been
+	// waited for, after which its PID may belong to another process.
+	OnExit func(*os.Process)
+	// Backend runs the conversion; nil means FFmpeg.
+	Backend Backend
+	// Limits bound the conversion's time and the ffmpeg processes it runs.
+	Limits Limits
+	// Paused, when set, reports how long the conversion has spent
+	// suspended, as callers do through the process from OnStart. The
+	// timeout in Limits doesn't count that time.
+	Paused func() time.Duration
+}
+
+func DefaultOptions() Options {
+	return Options{Params: DefaultParams(), Intensity: 1.0}
+}
+
+func (o Options) Validate() error {
+	if math.IsNaN(o.Intensity) || o.Intensity < MinIntensity || o.Intensity > MaxIntensity {
+		return invalid(fmt.Sprintf("intensity must be between %g and %g", MinIntensity, MaxIntensity))
+	}
+	if err := o.Segment.validate(); err != nil {
+		return err
+	}
+	return o.Params.validate()
+}
+
+// Duration probes the duration of the audio file at input.
+func Duration(input string, opts Options) (time.Duration, error) {
+	return opts.backend().Probe(input, opts)
+}
+
+func (ffmpegBackend) Probe(input string, opts Options) (time.Duration, error) {
+	binary, err := resolveBinary(opts.Binary)
+	if err != nil {
+		return 0, err
+	}
+	d, err := ffmpeg.Duration(binary, input)
+	if err != nil {
+		return 0, probeError(err)
+	}
+	return d, nil
+}
+
+// Convert reads audio from r and writes the processed MP3 to w. The input is
+// spooled to a temporary file because ffmpeg needs to seek and probe it.
+func Convert(ctx context.Context, r io.Reader, w io.Writer, opts Options) error {
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp("", "copyrem-")
+	if err != nil {
+		return fmt.Errorf("temp dir: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	input := filepath.Join(dir, "input")
+	f, err := os.Create(input)
+	if err != nil {
+		return fmt.Errorf("temp input: %w", err)
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("read input: %w", err)
+	}
+
+	output := filepath.Join(dir, "output.mp3")
+	if err := ConvertFile(ctx, input, output, opts); err != nil {
+		return err
+	}
+	out, err := os.Open(output)
+	if err != nil {
+		return fmt.Errorf("open output: %w", err)
+	}
+	defer out.Close()
+	if _, err := io.Copy(w, out); err != nil {
+		return fmt.Errorf("write output: %w", err)
+	}
+	return nil
+}
+
+// Output is a rendition and the path to write it to.
+type Output struct {
+	Rendition Rendition
+	Path      string
+}
+
+// ConvertFile processes the audio file at input and writes an MP3 to output.
+func ConvertFile(ctx context.Context, input, output string, opts Options) error {
+	return ConvertOutputs(ctx, input, []Output{{Rendition: opts.Params.DefaultRendition(), Path: output}}, opts)
+}
+
+// ConvertOutputs processes the audio file at input once and encodes it to
+// every output in a single ffmpeg run.
+func ConvertOutputs(ctx context.Context, input string, outputs []Output, opts Options) error {
+	return convert(ctx, input, outputs, opts, nil)
+}
+
+// convert runs ConvertOutputs on opts.Backend. With a stream, the only
+// output is written to it and progress is not reported.
+func convert(ctx context.Context, input string, outputs []Output, opts Options, stream io.Writer) error {
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+	if len(outputs) == 0 {
+		return invalid("no outputs")
+	}
+	for _, o := range outputs {
+		if err := o.Rendition.validate(); err != nil {
+			return err
+		}
+		// Copied video can only be cut at keyframes, which would leave
+		// it out of step with the sample-accurate audio.
+		if o.Rendition.IsVideo() && (opts.Segment.Start != 0 || opts.Segment.End != 0) {
+			return invalid("video outputs cannot be trimmed")
+		}
+	}
+	b := opts.backend()
+	if err := b.Capabilities().check(b.Name(), outputs, opts); err != nil {
+		return err
+	}
+	if stream != nil {
+		opts.OnProgress = nil
+	}
+	t := opts.Limits.Timeout
+	if opts.Limits.TimeoutPerMinute > 0 {
+		// An input that can't be probed fails in the backend.
+		d, _ := b.Probe(input, opts)
+		t = opts.Limits.timeout(opts.Segment.Length(d))
+	}
+	if t > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = withTimeout(ctx, t, opts.Paused)
+		defer cancel()
+	}
+	err := b.Convert(ctx, input, outputs, opts, stream)
+	if err != nil && context.Cause(ctx) == ErrTimeout {
+		return fmt.Errorf("%w after %s", ErrTimeout, t.Round(time.Second))
+	}
+	return err
+}
+
+// Convert runs the chain as one ffmpeg process, writing a stream through
+// its stdout.
+func (ffmpegBackend) Convert(ctx context.Context, input string, outputs []Output, opts Options, stream io.Writer) error {
+	binary, err := resolveBinary(opts.Binary)
+	if err != nil {
+		return err
+	}
+
+	onProgress := opts.OnProgress
+	seg := opts.Segment
+	var duration time.Duration
+	if onProgress != nil || !seg.IsZero() {
+		if onProgress != nil {
+			onProgress(Progress{Stage: StageProbing})
+		}
+		dur, err := ffmpeg.Duration(binary, input)
+		switch {
+		case err == nil && dur > 0:
+			duration = dur
+		case !seg.IsZero():
+			// Trims and fades are placed relative to the input's length.
+			if err == nil {
+				err = fmt.Errorf("unknown input duration")
+			}
+			return probeError(err)
+		}
+		if !seg.IsZero() {
+			if err := seg.Check(duration); err != nil {
+				return err
+			}
+		}
+	}
+	total := seg.Length(duration)
+
+	// Seek to the start on the input side so ffmpeg doesn't decode the
+	// audio before it; the filters then see the selection from zero.
+	seek, rel := seg.Start, seg
+	rel.Start = 0
+	if rel.End > 0 {
+		rel.End -= seek
+	}
+	filter := filterChain(opts.Params, opts.Intensity)
+	if parts := rel.filters(duration - seek); len(parts) > 0 {
+		filter = strings.Join(parts, ",") + "," + filter
+	}
+	var inputArgs []string
+	if seek > 0 {
+		inputArgs = append(inputArgs, "-ss", seconds(seek))
+	}
+	if slices.ContainsFunc(outputs, func(o Output) bool { return o.Rendition.IsVideo() }) {
+		// The chain slows the audio down by the tempo factor; stretch the
+		// copied video's timestamps to match instead of re-encoding it.
+		scale := 1 / tempoFactor(opts.Params, opts.Intensity)
+		inputArgs = append(inputArgs, "-itsscale:v", strconv.FormatFloat(scale, 'f', 6, 64))
+	}
+	args := buildArgs(opts.Params, inputArgs, input, outputs, filter, opts.Metadata)
+	if onProgress != nil {
+		args = append([]string{"-progress", "pipe:1"}, args...)
+	}
+
+	cmd := opts.Limits.command(ctx, binary, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	cmd.Stdout = stream
+
+	var stdout io.ReadCloser
+	if onProgress != nil {
+		if stdout, err = cmd.StdoutPipe(); err != nil {
+			return fmt.Errorf("stdout pipe: %w", err)
+		}
+	}
+
+	if err := opts.Limits.start(cmd); err != nil {
+		return &Error{Op: "ffmpeg start", Err: err}
+	}
+	if opts.OnStart != nil {
+		opts.OnStart(cmd.Process)
+	}
+
+	if stdout != nil {
+		trackProgress(stdout, StageEncoding, total, tempoFactor(opts.Params, opts.Intensity), onProgress)
+		_, _ = io.Copy(io.Discard, stdout)
+	}
+
+	err = opts.Limits.wait(cmd)
+	if opts.OnExit != nil {
+		opts.OnExit(cmd.Process)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return &Error{Op: "ffmpeg", Err: err, Stderr: strings.TrimSpace(stderr.String())}
+	}
+	if onProgress != nil {
+		final := Progress{Stage: StageEncoding, Percent: 100, Processed: total, Total: total, Done: true}
+		for _, o := range outputs {
+			if fi, err := os.Stat(o.Path); err == nil {
+				final.OutputSize += fi.Size()
+			}
+		}
+		onProgress(final)
+	}
+	return nil
+}
+
+// probeError wraps a failed probe, keeping what ffprobe reported.
+func probeError(err error) *Error {
+	e := &Error{Op: "probe", Err: err}
+	var pe *ffmpeg.ProbeError
+	if errors.As(err, &pe) {
+		e.Err, e.Stderr = pe.Err, pe.Stderr
+	}
+	return e
+}
+
+func resolveBinary(binary string) (string, error) {
+	if binary == "" {
+		binary = ffmpeg.FindBinary()
+	}
+	p, err := exec.LookPath(binary)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrBinaryNotFound, binary)
+	}
+	return p, nil
+}
+
+func buildArgs(cfg Params, inputArgs []string, input string, outputs []Output, filter string, metadata map[string]string) []string {
+	args := append([]string{"-y"}, inputArgs...)
+	args = append(args, "-i", input)
+	tags := metadataArgs(metadata)
+	if len(outputs) == 1 {
+		if outputs[0].Rendition.IsVideo() {
+			args = append(args, "-map", "0:v?")
+		}
+		args = append(args, "-map", "0:a:0", "-af", filter)
+		return append(args, outputArgs(cfg, outputs[0], tags)...)
+	}
+
+	// Run the chain once and split it, so every rendition is encoded from
+	// the same processed signal.
+	labels := make([]string, len(outputs))
+	for i := range outputs {
+		labels[i] = fmt.Sprintf("[o%d]", i)
+	}
+	graph := fmt.Sprintf("[0:a]%s,asplit=%d%s", filter, len(outputs), strings.Join(labels, ""))
+	args = append(args, "-filter_complex", graph)
+	for i, o := range outputs {
+		if o.Rendition.IsVideo() {
+			args = append(args, "-map", "0:v?")
+		}
+		args = append(args, "-map", labels[i])
+		args = append(args, outputArgs(cfg, o, tags)...)
+	}
+	return args
+}
+
+func outputArgs(cfg Params, o Output, tags []string) []string {
+	args := o.Rendition.encoderArgs(cfg)
+	if o.Path == streamOutput {
+		args = append(args, "-f", formats[o.Rendition.Format].muxer)
+	}
+	args = append(args, tags...)
+	return append(args, o.Path)
+}
+
+// metadataArgs returns -metadata flags in key order, so equal tags give
+// equal arguments.
+func metadataArgs(metadata map[string]string) []string {
+	var args []string
+	for _, k := range slices.Sorted(maps.Keys(metadata)) {
+		args = append(args, "-metadata", k+"="+metadata[k])
+	}
+	return args
+}
+
+func filterChain(cfg Params, intensity float64) string {
+	sr := cfg.SampleRate
+	p := math.Pow(2, (cfg.PitchSemitones*intensity)/12)
+
+	pitch := fmt.Sprintf("asetrate=%d*%.6f,aresample=%d,atempo=%.6f", sr, p, sr, 1/p)
+
+	tempo := fmt.Sprintf("atempo=%.4f", tempoFactor(cfg, intensity))
+
+	var resample []string
+	for _, r := range cfg.ResampleRates {
+		resample = append(resample, fmt.Sprintf("aresample=%d", r))
+	}
+	resample = append(resample, fmt.Sprintf("aresample=%d", sr))
+
+	delayL := int(float64(cfg.DelayLeftMs) * intensity)
+	delayR := int(float64(cfg.DelayRightMs) * intensity)
+	delay := fmt.Sprintf("adelay=%d|%d", delayL, delayR)
+
+	parts := make([]string, 0, 2+len(resample)+1)
+	parts = append(parts, pitch, tempo)
+	parts = append(parts, resample...)
+	parts = append(parts, delay)
+	return strings.Join(parts, ",")
+}
+
+// tempoFactor is the speed the chain plays the audio at; the pitch shift
+// leaves the duration unchanged.
+func tempoFactor(cfg Params, intensity float64) float64 {
+	// Scale tempo: if TempoFactor < 1, higher intensity makes it slower
+	var tf float64
+	if cfg.TempoFactor < 1.0 {
+		tf = 1.0 - (1.0-cfg.TempoFactor)*intensity
+	} else {
+		tf = 1.0 + (cfg.TempoFactor-1.0)*intensity
+	}
+	// Clamp tempo to ffmpeg limits (0.5 to 2.0 per atempo filter)
+	return math.Max(0.5, math.Min(2.0, tf))
+}
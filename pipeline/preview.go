@@ -0,0 +1,44 @@
+package pipeline
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+const (
+	DefaultPreviewLength = 20 * time.Second
+	MaxPreviewLength     = time.Minute
+)
+
+// streamOutput is the output path that writes to ffmpeg's stdout.
+const streamOutput = "pipe:1"
+
+// Preview processes the part of input that opts.Segment selects, which must
+// be at most MaxPreviewLength long, and streams it to w encoded as r. An end
+// past the end of the input is moved back to it. Writes to w start as soon
+// as ffmpeg produces output.
+func Preview(ctx context.Context, input string, w io.Writer, r Rendition, opts Options) error {
+	if err := r.validate(); err != nil {
+		return err
+	}
+	if r.IsVideo() {
+		return invalid("previews are audio only")
+	}
+	seg := opts.Segment
+	if seg.End == 0 || seg.End-seg.Start > MaxPreviewLength {
+		return invalid("a preview needs an end at most " + MaxPreviewLength.String() + " after its start")
+	}
+	duration, err := Duration(input, opts)
+	if err != nil {
+		return err
+	}
+	if seg.End > duration && seg.Start < duration {
+		seg.End = duration
+		if seg.FadeIn+seg.FadeOut > seg.End-seg.Start {
+			seg.FadeIn, seg.FadeOut = 0, 0
+		}
+		opts.Segment = seg
+	}
+	return convert(ctx, input, []Output{{Rendition: r, Path: streamOutput}}, opts, w)
+}
@@ -0,0 +1,97 @@
+package pipeline
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	StageProbing   = "probing"
+	StageAnalyzing = "analyzing"
+	StageEncoding  = "encoding"
+)
+
+// Progress describes how far a conversion has come. Total is the length of
+// the selected part of the input; it, Percent and ETA are zero when the input
+// duration could not be determined.
+type Progress struct {
+	Stage      string
+	Percent    int
+	Processed  time.Duration
+	Total      time.Duration
+	Speed      float64
+	ETA        time.Duration
+	OutputSize int64
+	Bitrate    string
+	Done       bool
+}
+
+// trackProgress parses ffmpeg's -progress key=value blocks and reports them
+// at most every progressMinInterval unless the percentage jumps by
+// progressMinStep or more. ffmpeg reports output time; scale converts it
+// back to input time, which total is measured in.
+func trackProgress(stdout io.Reader, stage string, total time.Duration, scale float64, onProgress func(Progress)) {
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 256), 256)
+	cur := Progress{Stage: stage, Total: total}
+	lastPct := 0
+	lastReport := time.Time{}
+
+	for scanner.Scan() {
+		key, val, ok := strings.Cut(scanner.Text(), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "out_time_us":
+			if us, err := strconv.ParseInt(val, 10, 64); err == nil && us >= 0 {
+				cur.Processed = time.Duration(float64(us)*scale) * time.Microsecond
+				if total > 0 {
+					cur.Processed = min(cur.Processed, total)
+				}
+			}
+		case "speed":
+			if x, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(val), "x"), 64); err == nil {
+				cur.Speed = x * scale
+			}
+		case "total_size":
+			if n, err := strconv.ParseInt(val, 10, 64); err == nil {
+				cur.OutputSize = n
+			}
+		case "bitrate":
+			if val != "N/A" {
+				cur.Bitrate = strings.TrimSpace(val)
+			}
+		case "progress":
+			if val == "end" {
+				return
+			}
+			cur.Percent, cur.ETA = estimate(cur.Processed, total, cur.Speed)
+			if cur.Percent < lastPct {
+				cur.Percent = lastPct
+			}
+			now := time.Now()
+			if cur.Percent-lastPct >= progressMinStep || now.Sub(lastReport) >= progressMinInterval {
+				lastPct = cur.Percent
+				lastReport = now
+				onProgress(cur)
+			}
+		}
+	}
+}
+
+func estimate(processed, total time.Duration, speed float64) (int, time.Duration) {
+	if total <= 0 {
+		return 0, 0
+	}
+	pct := int(math.Min(99, float64(processed)/float64(total)*100))
+	var eta time.Duration
+	if speed > 0 && processed < total {
+		eta = time.Duration(float64(total-processed) / speed)
+	}
+	return pct, eta
+}
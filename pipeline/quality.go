@@ -0,0 +1,464 @@
+package pipeline
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/cmplx"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// compareRate is the rate Compare decodes both signals at.
+	compareRate = 22050
+	// Compare correlates the first alignWindow of both signals to find
+	// their offset, searching up to maxOffset either way.
+	alignWindow = 10 * time.Second
+	maxOffset   = time.Second
+
+	spectrumSize = 4096
+	// bandwidthFloor is the power, relative to the strongest frequency,
+	// below which the average spectrum no longer counts as signal (-60 dB).
+	bandwidthFloor = 1e-6
+	// clipLevel is the magnitude at which a sample counts as clipped: full
+	// scale for 16-bit audio.
+	clipLevel = 32767.0 / 32768
+	// levelLimitDB bounds levels and ratios that would be infinite for
+	// silent or identical signals, which JSON cannot carry.
+	levelLimitDB = 120.0
+)
+
+// AudioStats are objective measurements of an audio stream.
+type AudioStats struct {
+	SampleRate int `json:"sample_rate"`
+	Channels   int `json:"channels"`
+	// Loudness is the integrated loudness per EBU R128.
+	Loudness float64 `json:"loudness_lufs"`
+	TruePeak float64 `json:"true_peak_dbtp"`
+	RMS      float64 `json:"rms_dbfs"`
+	// Clipped counts samples, over all channels, at or beyond full scale.
+	Clipped int64 `json:"clipped_samples"`
+	// Bandwidth is the highest frequency at which the average spectrum is
+	// within 60 dB of its strongest frequency.
+	Bandwidth float64 `json:"bandwidth_hz"`
+}
+
+// Measure decodes the part of the first audio stream of input that
+// opts.Segment selects, ignoring fades, and measures it.
+func Measure(ctx context.Context, input string, opts Options) (AudioStats, error) {
+	if err := opts.checkAnalysis("measure audio"); err != nil {
+		return AudioStats{}, err
+	}
+	binary, err := resolveBinary(opts.Binary)
+	if err != nil {
+		return AudioStats{}, err
+	}
+	args := append([]string{"-hide_banner", "-nostats"}, segmentInput(opts.Segment, input)...)
+	args = append(args, "-map", "0:a:0", "-af", "ebur128=peak=true:framelog=quiet", "-c:a", "pcm_f32le", "-f", "wav", "pipe:1")
+	var st AudioStats
+	stderr, err := decode(ctx, opts.Limits, binary, args,
+		func(r io.Reader) (err error) {
+			st, err = readStats(r)
+			return err
+		})
+	if err != nil {
+		return AudioStats{}, err
+	}
+	if st.Loudness, st.TruePeak, err = parseLoudness(stderr); err != nil {
+		return AudioStats{}, &Error{Op: "ebur128", Err: err}
+	}
+	return st, nil
+}
+
+// readStats measures float samples in a WAV stream.
+func readStats(r io.Reader) (AudioStats, error) {
+	br := bufio.NewReaderSize(r, 64<<10)
+	f, _, err := readWAVHeader(br)
+	if err != nil {
+		return AudioStats{}, err
+	}
+	if f.tag != waveFloat || f.bits != 32 {
+		return AudioStats{}, errors.New("expected 32-bit float WAV")
+	}
+	channels, rate := f.channels, f.rate
+	st := AudioStats{SampleRate: rate, Channels: channels}
+	spec := newSpectrum()
+	frame := make([]byte, 4*channels)
+	var sumSq float64
+	var n int64
+	for {
+		if _, err := io.ReadFull(br, frame); err != nil {
+			if err != io.EOF && err != io.ErrUnexpectedEOF {
+				return AudioStats{}, err
+			}
+			break
+		}
+		var mono float64
+		for c := range channels {
+			x := float64(math.Float32frombits(binary.LittleEndian.Uint32(frame[4*c:])))
+			sumSq += x * x
+			if math.Abs(x) >= clipLevel {
+				st.Clipped++
+			}
+			mono += x
+		}
+		n += int64(channels)
+		spec.add(mono / float64(channels))
+	}
+	st.RMS = -levelLimitDB
+	if n > 0 {
+		st.RMS = round2(decibels(sumSq / float64(n)))
+	}
+	st.Bandwidth = spec.bandwidth(rate)
+	return st, nil
+}
+
+// parseLoudness reads the integrated loudness and true peak from the
+// summary ebur128 logs when it closes.
+func parseLoudness(stderr string) (lufs, peak float64, err error) {
+	_, summary, ok := strings.Cut(stderr, "Summary:")
+	if !ok {
+		return 0, 0, errors.New("no loudness summary")
+	}
+	var found int
+	for _, line := range strings.Split(summary, "\n") {
+		f := strings.Fields(line)
+		if len(f) < 2 || (f[0] != "I:" && f[0] != "Peak:") {
+			continue
+		}
+		v, err := strconv.ParseFloat(f[1], 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid %s %q", f[0], f[1])
+		}
+		v = min(max(v, -levelLimitDB), levelLimitDB)
+		if f[0] == "I:" {
+			lufs = v
+		} else {
+			peak = v
+		}
+		found++
+	}
+	if found < 2 {
+		return 0, 0, errors.New("incomplete loudness summary")
+	}
+	return lufs, peak, nil
+}
+
+// spectrum averages the power spectrum of a signal over Hann-windowed
+// frames.
+type spectrum struct {
+	plan   fftPlan
+	window []float64
+	frame  []float64
+	buf    []complex128
+	power  []float64
+	frames int
+}
+
+func newSpectrum() *spectrum {
+	s := &spectrum{
+		plan:   newFFTPlan(spectrumSize),
+		window: make([]float64, spectrumSize),
+		buf:    make([]complex128, spectrumSize),
+		power:  make([]float64, spectrumSize/2+1),
+	}
+	for i := range s.window {
+		s.window[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/spectrumSize)
+	}
+	return s
+}
+
+func (s *spectrum) add(x float64) {
+	if s.frame = append(s.frame, x); len(s.frame) == spectrumSize {
+		s.flush()
+	}
+}
+
+func (s *spectrum) flush() {
+	for i := range s.buf {
+		var v float64
+		if i < len(s.frame) {
+			v = s.frame[i] * s.window[i]
+		}
+		s.buf[i] = complex(v, 0)
+	}
+	s.plan.transform(s.buf)
+	for k := range s.power {
+		b := s.buf[k]
+		s.power[k] += real(b)*real(b) + imag(b)*imag(b)
+	}
+	s.frames++
+	s.frame = s.frame[:0]
+}
+
+func (s *spectrum) bandwidth(rate int) float64 {
+	if s.frames == 0 && len(s.frame) > 0 {
+		s.flush()
+	}
+	var peak float64
+	for _, p := range s.power[1:] {
+		peak = max(peak, p)
+	}
+	if peak == 0 {
+		return 0
+	}
+	for k := len(s.power) - 1; k > 0; k-- {
+		if s.power[k] >= peak*bandwidthFloor {
+			return math.Round(float64(k) * float64(rate) / spectrumSize)
+		}
+	}
+	return 0
+}
+
+// Comparison measures how far a conversion's output departs from its input.
+type Comparison struct {
+	// SNR is the ratio, in dB, of the input's energy to the energy of its
+	// difference from the output, once the two are aligned in time and
+	// level. Pitch shifts lower it as much as noise does.
+	SNR float64
+	// Offset is how far the output lags the input.
+	Offset time.Duration
+}
+
+// Compare decodes the part of input that opts.Segment selects and the
+// output of converting it with opts, undoes the output's tempo change,
+// aligns the two and compares them. Both are mixed down to mono.
+func Compare(ctx context.Context, input, output string, opts Options) (Comparison, error) {
+	if err := opts.checkAnalysis("compare audio"); err != nil {
+		return Comparison{}, err
+	}
+	binary, err := resolveBinary(opts.Binary)
+	if err != nil {
+		return Comparison{}, err
+	}
+	undo := fmt.Sprintf("atempo=%.6f", 1/tempoFactor(opts.Params, opts.Intensity))
+	x, err := startPCM(ctx, opts.Limits, binary, segmentInput(opts.Segment, input), "")
+	if err != nil {
+		return Comparison{}, err
+	}
+	y, err := startPCM(ctx, opts.Limits, binary, []string{"-i", output}, undo)
+	if err != nil {
+		_ = x.wait()
+		return Comparison{}, err
+	}
+
+	window := int(alignWindow.Seconds() * compareRate)
+	lag := bestLag(x.take(window), y.take(window), int(maxOffset.Seconds()*compareRate))
+	if lag > 0 {
+		y.skip(lag)
+	} else {
+		x.skip(-lag)
+	}
+	var sxx, syy, sxy float64
+	for {
+		a, ok := x.next()
+		b, ok2 := y.next()
+		if !ok || !ok2 {
+			break
+		}
+		sxx += a * a
+		syy += b * b
+		sxy += a * b
+	}
+	xerr, yerr := x.wait(), y.wait()
+	if ctx.Err() != nil {
+		return Comparison{}, ctx.Err()
+	}
+	if err := errors.Join(xerr, yerr); err != nil {
+		return Comparison{}, err
+	}
+
+	// Scale the output to best match the input before taking the
+	// difference, so level changes don't count as noise.
+	noise := sxx
+	if syy > 0 {
+		noise -= sxy * sxy / syy
+	}
+	c := Comparison{Offset: time.Duration(lag) * time.Second / compareRate}
+	if sxx > 0 {
+		c.SNR = round2(-decibels(max(noise, 0) / sxx))
+	}
+	return c, nil
+}
+
+// segmentInput returns the input arguments that read the part of input seg
+// selects.
+func segmentInput(seg Segment, input string) []string {
+	var args []string
+	if seg.Start > 0 {
+		args = append(args, "-ss", seconds(seg.Start))
+	}
+	args = append(args, "-i", input)
+	if seg.End > 0 {
+		args = append(args, "-t", seconds(seg.End-seg.Start))
+	}
+	return args
+}
+
+// bestLag returns the lag, at most maxLag either way, at which y correlates
+// best with x: y[n+lag] matches x[n].
+func bestLag(x, y []float64, maxLag int) int {
+	if len(x) == 0 || len(y) == 0 {
+		return 0
+	}
+	n := nextPow2(len(x) + len(y))
+	plan := newFFTPlan(n)
+	a, b := make([]complex128, n), make([]complex128, n)
+	for i, v := range x {
+		a[i] = complex(v, 0)
+	}
+	for i, v := range y {
+		b[i] = complex(v, 0)
+	}
+	plan.transform(a)
+	plan.transform(b)
+	// The inverse transform of conj(A)·B is the cross-correlation; take it
+	// as the conjugate of the forward transform of the conjugate.
+	for i := range a {
+		a[i] = cmplx.Conj(cmplx.Conj(a[i]) * b[i])
+	}
+	plan.transform(a)
+	best, lag := math.Inf(-1), 0
+	for l := -min(maxLag, n/2-1); l <= min(maxLag, n/2-1); l++ {
+		if c := real(a[(l+n)%n]); c > best {
+			best, lag = c, l
+		}
+	}
+	return lag
+}
+
+// decibels converts a power ratio to dB, within ±levelLimitDB.
+func decibels(ratio float64) float64 {
+	if ratio <= 0 {
+		return -levelLimitDB
+	}
+	return min(max(10*math.Log10(ratio), -levelLimitDB), levelLimitDB)
+}
+
+func round2(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+// pcmStream decodes the first audio stream of a file to mono float samples
+// at compareRate.
+type pcmStream struct {
+	cmd     *exec.Cmd
+	limits  Limits
+	r       *bufio.Reader
+	stderr  bytes.Buffer
+	pending []float64
+	eof     bool
+}
+
+func startPCM(ctx context.Context, l Limits, binary string, inputArgs []string, filter string) (*pcmStream, error) {
+	args := append([]string{"-v", "error"}, inputArgs...)
+	args = append(args, "-map", "0:a:0")
+	if filter != "" {
+		args = append(args, "-af", filter)
+	}
+	args = append(args, "-ac", "1", "-ar", strconv.Itoa(compareRate), "-f", "f32le", "-c:a", "pcm_f32le", "pipe:1")
+	s := &pcmStream{cmd: l.command(ctx, binary, args...), limits: l}
+	s.cmd.Stderr = &s.stderr
+	stdout, err := s.cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("stdout pipe: %w", err)
+	}
+	if err := l.start(s.cmd); err != nil {
+		return nil, &Error{Op: "ffmpeg start", Err: err}
+	}
+	s.r = bufio.NewReaderSize(stdout, 64<<10)
+	return s, nil
+}
+
+func (s *pcmStream) read() (float64, bool) {
+	var b [4]byte
+	if s.eof {
+		return 0, false
+	}
+	if _, err := io.ReadFull(s.r, b[:]); err != nil {
+		s.eof = true
+		return 0, false
+	}
+	return float64(math.Float32frombits(binary.LittleEndian.Uint32(b[:]))), true
+}
+
+func (s *pcmStream) next() (float64, bool) {
+	if len(s.pending) > 0 {
+		v := s.pending[0]
+		s.pending = s.pending[1:]
+		return v, true
+	}
+	return s.read()
+}
+
+// take returns up to n samples from the start of what is left, which next
+// then returns again.
+func (s *pcmStream) take(n int) []float64 {
+	for len(s.pending) < n {
+		v, ok := s.read()
+		if !ok {
+			break
+		}
+		s.pending = append(s.pending, v)
+	}
+	return s.pending[:min(n, len(s.pending))]
+}
+
+func (s *pcmStream) skip(n int) {
+	for range n {
+		if _, ok := s.next(); !ok {
+			return
+		}
+	}
+}
+
+// wait stops ffmpeg if its output was not read to the end, and reaps it.
+func (s *pcmStream) wait() error {
+	if !s.eof {
+		_ = s.cmd.Process.Kill()
+	}
+	if err := s.limits.wait(s.cmd); err != nil && s.eof {
+		return &Error{Op: "ffmpeg", Err: err, Stderr: strings.TrimSpace(s.stderr.String())}
+	}
+	return nil
+}
+
+// decode runs ffmpeg with args, which write to stdout, and passes its output
+// to read. It returns ffmpeg's log. ffmpeg is stopped if read fails other
+// than by running out of data, which ffmpeg's own error then explains.
+func decode(ctx context.Context, l Limits, binary string, args []string, read func(io.Reader) error) (string, error) {
+	cmd := l.command(ctx, binary, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", fmt.Errorf("stdout pipe: %w", err)
+	}
+	if err := l.start(cmd); err != nil {
+		return "", &Error{Op: "ffmpeg start", Err: err}
+	}
+	rerr := read(stdout)
+	truncated := errors.Is(rerr, io.EOF) || errors.Is(rerr, io.ErrUnexpectedEOF)
+	if rerr != nil && !truncated {
+		_ = cmd.Process.Kill()
+	}
+	_, _ = io.Copy(io.Discard, stdout)
+	werr := l.wait(cmd)
+	switch {
+	case ctx.Err() != nil:
+		return "", ctx.Err()
+	case werr != nil && (rerr == nil || truncated):
+		return "", &Error{Op: "ffmpeg", Err: werr, Stderr: strings.TrimSpace(stderr.String())}
+	case rerr != nil:
+		return "", rerr
+	}
+	return stderr.String(), nil
+}
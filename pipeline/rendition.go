@@ -0,0 +1,180 @@
+package pipeline
+
+import (
+	"cmp"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var reBitrate = regexp.MustCompile(`^[1-9][0-9]{0,3}k$`)
+
+// Rendition is one encoded output of a conversion. When Container is set,
+// the output is the input's video, copied as is, with the processed audio
+// in Format muxed into that container.
+type Rendition struct {
+	Name      string `json:"name"`
+	Format    string `json:"format"`
+	Bitrate   string `json:"bitrate,omitempty"`
+	Container string `json:"container,omitempty"`
+}
+
+type format struct {
+	codec      string
+	ext        string
+	mime       string
+	lossless   bool
+	sampleRate int
+	// muxer and streamMIME describe the format when it is streamed to a
+	// pipe, where MP4 can't be written; streamMIME defaults to mime.
+	muxer      string
+	streamMIME string
+}
+
+var formats = map[string]format{
+	"mp3":  {codec: "libmp3lame", ext: ".mp3", mime: "audio/mpeg", muxer: "mp3"},
+	"aac":  {codec: "aac", ext: ".m4a", mime: "audio/mp4", muxer: "adts", streamMIME: "audio/aac"},
+	"opus": {codec: "libopus", ext: ".opus", mime: "audio/ogg", sampleRate: 48000, muxer: "ogg"},
+	"flac": {codec: "flac", ext: ".flac", mime: "audio/flac", lossless: true, muxer: "flac"},
+	"wav":  {codec: "pcm_s16le", ext: ".wav", mime: "audio/wav", lossless: true, muxer: "wav"},
+}
+
+type container struct {
+	ext   string
+	mime  string
+	audio string
+	flags []string
+}
+
+// containers are the video formats processed audio can be muxed back into,
+// with the audio format each gets.
+var containers = map[string]container{
+	"mp4":  {ext: ".mp4", mime: "video/mp4", audio: "aac", flags: []string{"-movflags", "+faststart"}},
+	"mov":  {ext: ".mov", mime: "video/quicktime", audio: "aac", flags: []string{"-movflags", "+faststart"}},
+	"mkv":  {ext: ".mkv", mime: "video/x-matroska", audio: "aac"},
+	"webm": {ext: ".webm", mime: "video/webm", audio: "opus"},
+}
+
+// VideoContainers lists the video formats, by extension, that inputs may
+// come in and VideoRendition accepts.
+func VideoContainers() []string {
+	exts := make([]string, 0, len(containers))
+	for _, c := range containers {
+		exts = append(exts, c.ext)
+	}
+	sort.Strings(exts)
+	return exts
+}
+
+// VideoRendition is the rendition that keeps the video of an input in the
+// given container, such as "mp4" or ".mov", and replaces its audio.
+func VideoRendition(name string) (Rendition, error) {
+	name = strings.TrimPrefix(strings.ToLower(name), ".")
+	c, ok := containers[name]
+	if !ok {
+		return Rendition{}, invalid(fmt.Sprintf("unsupported video container %q", name))
+	}
+	return Rendition{Name: "video", Format: c.audio, Container: name}, nil
+}
+
+// Formats lists the output formats renditions can use.
+func Formats() []string {
+	names := make([]string, 0, len(formats))
+	for name := range formats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParseRendition reads names like "mp3_128", "opus_96" or "flac": a format,
+// optionally followed by a bitrate in kbps for lossy formats.
+func ParseRendition(s string) (Rendition, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	name, kbps, hasRate := strings.Cut(s, "_")
+	f, ok := formats[name]
+	if !ok {
+		return Rendition{}, invalid(fmt.Sprintf("unknown rendition %q", s))
+	}
+	r := Rendition{Name: s, Format: name}
+	if hasRate {
+		if f.lossless {
+			return Rendition{}, invalid(fmt.Sprintf("%s takes no bitrate", name))
+		}
+		if n, err := strconv.Atoi(kbps); err != nil || n <= 0 {
+			return Rendition{}, invalid(fmt.Sprintf("invalid bitrate in %q", s))
+		}
+		r.Bitrate = kbps + "k"
+	}
+	return r, r.validate()
+}
+
+// DefaultRendition is the MP3 output the Params describe.
+func (p Params) DefaultRendition() Rendition {
+	return Rendition{Name: "mp3", Format: "mp3", Bitrate: p.Bitrate}
+}
+
+func (r Rendition) Ext() string {
+	if r.Container != "" {
+		return containers[r.Container].ext
+	}
+	return formats[r.Format].ext
+}
+
+func (r Rendition) MIMEType() string {
+	if r.Container != "" {
+		return containers[r.Container].mime
+	}
+	return formats[r.Format].mime
+}
+
+// StreamMIMEType is the content type of r as Preview streams it.
+func (r Rendition) StreamMIMEType() string {
+	f := formats[r.Format]
+	return cmp.Or(f.streamMIME, f.mime)
+}
+
+func (r Rendition) IsVideo() bool { return r.Container != "" }
+
+func (r Rendition) validate() error {
+	f, ok := formats[r.Format]
+	if !ok {
+		return invalid(fmt.Sprintf("unknown format %q", r.Format))
+	}
+	if r.Name == "" {
+		return invalid("rendition name is required")
+	}
+	if r.Bitrate != "" && (f.lossless || !reBitrate.MatchString(r.Bitrate)) {
+		return invalid(fmt.Sprintf("invalid bitrate %q for %s", r.Bitrate, r.Format))
+	}
+	if r.Container != "" {
+		if c, ok := containers[r.Container]; !ok || c.audio != r.Format {
+			return invalid(fmt.Sprintf("invalid video container %q for %s", r.Container, r.Format))
+		}
+	}
+	return nil
+}
+
+func (r Rendition) encoderArgs(p Params) []string {
+	f := formats[r.Format]
+	args := []string{"-c:a", f.codec}
+	if !f.lossless {
+		bitrate := r.Bitrate
+		if bitrate == "" {
+			bitrate = p.Bitrate
+		}
+		args = append(args, "-b:a", bitrate)
+	}
+	sr := p.SampleRate
+	if f.sampleRate != 0 {
+		sr = f.sampleRate
+	}
+	args = append(args, "-ar", strconv.Itoa(sr), "-ac", strconv.Itoa(p.Channels))
+	if r.Container != "" {
+		args = append(args, "-c:v", "copy")
+		args = append(args, containers[r.Container].flags...)
+	}
+	return args
+}
@@ -0,0 +1,148 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// silenceThreshold is the level below which leading and trailing audio
+// counts as silence when Segment.TrimSilence is set.
+const silenceThreshold = "-50dB"
+
+// Segment selects and shapes the part of the input that is processed. All
+// times refer to the input timeline; the zero value processes all of it.
+type Segment struct {
+	Start time.Duration
+	// End is exclusive; zero means the end of the input.
+	End     time.Duration
+	FadeIn  time.Duration
+	FadeOut time.Duration
+	// TrimSilence removes silence at the head and tail of the selection.
+	TrimSilence bool
+}
+
+func (s Segment) IsZero() bool { return s == Segment{} }
+
+func (s Segment) validate() error {
+	if s.Start < 0 || s.End < 0 {
+		return invalid("start and end must not be negative")
+	}
+	if s.End > 0 && s.End <= s.Start {
+		return invalid("end must be after start")
+	}
+	if s.FadeIn < 0 || s.FadeOut < 0 {
+		return invalid("fades must not be negative")
+	}
+	if s.End > 0 && s.FadeIn+s.FadeOut > s.End-s.Start {
+		return invalid("fades are longer than the selection")
+	}
+	return nil
+}
+
+// Check validates s against an input of the given duration.
+func (s Segment) Check(duration time.Duration) error {
+	if err := s.validate(); err != nil {
+		return err
+	}
+	if s.Start >= duration {
+		return invalid(fmt.Sprintf("start is past the end of the input (%.3fs)", duration.Seconds()))
+	}
+	if s.End > duration {
+		return invalid(fmt.Sprintf("end is past the end of the input (%.3fs)", duration.Seconds()))
+	}
+	if s.FadeIn+s.FadeOut > s.Length(duration) {
+		return invalid("fades are longer than the selection")
+	}
+	return nil
+}
+
+// Length is the duration of the selection within an input of the given
+// duration, before silence trimming.
+func (s Segment) Length(duration time.Duration) time.Duration {
+	end := duration
+	if s.End > 0 && s.End < end {
+		end = s.End
+	}
+	return max(end-s.Start, 0)
+}
+
+// filters returns the filters that cut and fade the selection, to run ahead
+// of the processing chain. duration is the input's duration.
+func (s Segment) filters(duration time.Duration) []string {
+	var parts []string
+	if s.Start > 0 || s.End > 0 {
+		var trim []string
+		if s.Start > 0 {
+			trim = append(trim, "start="+seconds(s.Start))
+		}
+		if s.End > 0 {
+			trim = append(trim, "end="+seconds(s.End))
+		}
+		parts = append(parts, "atrim="+strings.Join(trim, ":"), "asetpts=PTS-STARTPTS")
+	}
+	silence := "silenceremove=start_periods=1:start_threshold=" + silenceThreshold
+	if s.TrimSilence {
+		parts = append(parts, silence)
+	}
+	if s.FadeIn > 0 {
+		parts = append(parts, "afade=t=in:st=0:d="+seconds(s.FadeIn))
+	}
+	switch {
+	case s.TrimSilence:
+		// The tail's position is unknown until the silence is gone, so trim
+		// and fade it from the reversed signal.
+		parts = append(parts, "areverse", silence)
+		if s.FadeOut > 0 {
+			parts = append(parts, "afade=t=in:st=0:d="+seconds(s.FadeOut))
+		}
+		parts = append(parts, "areverse")
+	case s.FadeOut > 0:
+		st := s.Length(duration) - s.FadeOut
+		parts = append(parts, fmt.Sprintf("afade=t=out:st=%s:d=%s", seconds(st), seconds(s.FadeOut)))
+	}
+	return parts
+}
+
+func seconds(d time.Duration) string {
+	return strings.TrimRight(strings.TrimRight(fmt.Sprintf("%.3f", d.Seconds()), "0"), ".")
+}
+
+type segmentJSON struct {
+	Start       float64 `json:"start,omitempty"`
+	End         float64 `json:"end,omitempty"`
+	FadeIn      float64 `json:"fade_in,omitempty"`
+	FadeOut     float64 `json:"fade_out,omitempty"`
+	TrimSilence bool    `json:"trim_silence,omitempty"`
+}
+
+// MarshalJSON encodes times as seconds.
+func (s Segment) MarshalJSON() ([]byte, error) {
+	return json.Marshal(segmentJSON{
+		Start:       s.Start.Seconds(),
+		End:         s.End.Seconds(),
+		FadeIn:      s.FadeIn.Seconds(),
+		FadeOut:     s.FadeOut.Seconds(),
+		TrimSilence: s.TrimSilence,
+	})
+}
+
+func (s *Segment) UnmarshalJSON(b []byte) error {
+	var v segmentJSON
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	*s = Segment{
+		Start:       fromSeconds(v.Start),
+		End:         fromSeconds(v.End),
+		FadeIn:      fromSeconds(v.FadeIn),
+		FadeOut:     fromSeconds(v.FadeOut),
+		TrimSilence: v.TrimSilence,
+	}
+	return nil
+}
+
+func fromSeconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
@@ -0,0 +1,184 @@
+package pipeline
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"copyrem/internal/ffmpeg"
+)
+
+// SilenceSplit configures splitting a recording at silent gaps.
+type SilenceSplit struct {
+	// ThresholdDB is the level, in dBFS, below which audio counts as silence.
+	ThresholdDB float64
+	// MinGap is the shortest silence that separates two tracks.
+	MinGap time.Duration
+}
+
+func DefaultSilenceSplit() SilenceSplit {
+	return SilenceSplit{ThresholdDB: -50, MinGap: 2 * time.Second}
+}
+
+func (s SilenceSplit) validate() error {
+	if s.ThresholdDB >= 0 || s.ThresholdDB < -120 {
+		return invalid("silence threshold must be between -120 and 0 dB")
+	}
+	if s.MinGap < 100*time.Millisecond {
+		return invalid("silence gap must be at least 0.1s")
+	}
+	return nil
+}
+
+type silence struct {
+	start, end time.Duration
+}
+
+// DetectTracks finds the silent gaps in the audio file at input and returns
+// the audio between them as tracks named "Track N". Leading and trailing
+// silence is left out. Progress is reported with StageAnalyzing.
+func DetectTracks(ctx context.Context, input string, opts Options, s SilenceSplit) ([]Track, error) {
+	if err := s.validate(); err != nil {
+		return nil, err
+	}
+	if err := opts.checkAnalysis("detect silence"); err != nil {
+		return nil, err
+	}
+	binary, err := resolveBinary(opts.Binary)
+	if err != nil {
+		return nil, err
+	}
+	onProgress := opts.OnProgress
+	if onProgress != nil {
+		onProgress(Progress{Stage: StageProbing})
+	}
+	duration, err := ffmpeg.Duration(binary, input)
+	if err != nil {
+		return nil, probeError(err)
+	}
+
+	args := []string{"-hide_banner", "-nostats", "-i", input,
+		"-af", fmt.Sprintf("silencedetect=noise=%gdB:d=%s", s.ThresholdDB, seconds(s.MinGap)),
+		"-f", "null", "-"}
+	if onProgress != nil {
+		args = append([]string{"-progress", "pipe:1"}, args...)
+	}
+	cmd := opts.Limits.command(ctx, binary, args...)
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, fmt.Errorf("stderr pipe: %w", err)
+	}
+	var stdout io.ReadCloser
+	if onProgress != nil {
+		if stdout, err = cmd.StdoutPipe(); err != nil {
+			return nil, fmt.Errorf("stdout pipe: %w", err)
+		}
+	}
+	if err := opts.Limits.start(cmd); err != nil {
+		return nil, &Error{Op: "ffmpeg start", Err: err}
+	}
+	if opts.OnStart != nil {
+		opts.OnStart(cmd.Process)
+	}
+
+	var gaps []silence
+	var log strings.Builder
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		gaps = parseSilences(stderr, &log)
+	}()
+	if stdout != nil {
+		trackProgress(stdout, StageAnalyzing, duration, 1, onProgress)
+		_, _ = io.Copy(io.Discard, stdout)
+	}
+	wg.Wait()
+
+	err = opts.Limits.wait(cmd)
+	if opts.OnExit != nil {
+		opts.OnExit(cmd.Process)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, &Error{Op: "silencedetect", Err: err, Stderr: strings.TrimSpace(log.String())}
+	}
+	tracks := splitAtSilences(gaps, duration)
+	if len(tracks) > MaxTracks {
+		return nil, invalid(fmt.Sprintf("found %d tracks, at most %d are allowed", len(tracks), MaxTracks))
+	}
+	return tracks, nil
+}
+
+// parseSilences reads silencedetect's log lines; other lines go to rest,
+// which is kept for error reports.
+func parseSilences(r io.Reader, rest *strings.Builder) []silence {
+	var gaps []silence
+	open := false
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if v, ok := logValue(line, "silence_start:"); ok {
+			gaps = append(gaps, silence{start: v, end: -1})
+			open = true
+			continue
+		}
+		if v, ok := logValue(line, "silence_end:"); ok && open {
+			gaps[len(gaps)-1].end = v
+			open = false
+			continue
+		}
+		if rest.Len() < 64<<10 {
+			rest.WriteString(line + "\n")
+		}
+	}
+	_, _ = io.Copy(io.Discard, r)
+	return gaps
+}
+
+func logValue(line, key string) (time.Duration, bool) {
+	_, after, ok := strings.Cut(line, key)
+	if !ok {
+		return 0, false
+	}
+	f := strings.Fields(after)
+	if len(f) == 0 {
+		return 0, false
+	}
+	x, err := strconv.ParseFloat(f[0], 64)
+	if err != nil {
+		return 0, false
+	}
+	return max(time.Duration(x*float64(time.Second)), 0), true
+}
+
+// splitAtSilences returns the audio between gaps. A gap still open at the
+// end of the input (end < 0) is trailing silence.
+func splitAtSilences(gaps []silence, duration time.Duration) []Track {
+	var tracks []Track
+	start := time.Duration(0)
+	for _, g := range gaps {
+		if g.start > start {
+			tracks = append(tracks, Track{Start: start, End: g.start})
+		}
+		if g.end < 0 {
+			start = duration
+			break
+		}
+		start = g.end
+	}
+	if duration-start > 100*time.Millisecond {
+		tracks = append(tracks, Track{Start: start})
+	}
+	for i := range tracks {
+		tracks[i].Title = fmt.Sprintf("Track %d", i+1)
+	}
+	return tracks
+}
@@ -0,0 +1,362 @@
+package pipeline
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	MaxTracks = 500
+
+	maxTrackListBytes = 1 << 20
+	cueFramesPerSec   = 75
+)
+
+// Track is a part of a recording that is written to its own files.
+type Track struct {
+	Title     string
+	Performer string
+	Start     time.Duration
+	// End is exclusive; zero means the end of the input.
+	End time.Duration
+}
+
+// TrackList is a recording's track layout, from a CUE sheet, a chapter list
+// or silence detection. Title and Performer describe the whole recording.
+type TrackList struct {
+	Title     string
+	Performer string
+	Tracks    []Track
+}
+
+// Segment returns the part of the input covered by track i.
+func (l TrackList) Segment(i int) Segment {
+	return Segment{Start: l.Tracks[i].Start, End: l.Tracks[i].End}
+}
+
+// Metadata returns the tags to write into track i's files.
+func (l TrackList) Metadata(i int) map[string]string {
+	t := l.Tracks[i]
+	m := map[string]string{"track": fmt.Sprintf("%d/%d", i+1, len(l.Tracks))}
+	if t.Title != "" {
+		m["title"] = t.Title
+	}
+	if artist := cmp.Or(t.Performer, l.Performer); artist != "" {
+		m["artist"] = artist
+	}
+	if l.Title != "" {
+		m["album"] = l.Title
+	}
+	if l.Performer != "" {
+		m["album_artist"] = l.Performer
+	}
+	return m
+}
+
+// Check validates the list against an input of the given duration.
+func (l TrackList) Check(duration time.Duration) error {
+	if len(l.Tracks) == 0 {
+		return invalid("no tracks")
+	}
+	for i, t := range l.Tracks {
+		if t.Start >= duration {
+			return invalid(fmt.Sprintf("track %d starts past the end of the input (%.3fs)", i+1, duration.Seconds()))
+		}
+	}
+	return nil
+}
+
+// ParseTrackList reads a CUE sheet or a chapter list with one
+// "[[hh:]mm:]ss[.fff] Title" line per track. Each track ends where the next
+// one starts.
+func ParseTrackList(r io.Reader) (TrackList, error) {
+	b, err := io.ReadAll(io.LimitReader(r, maxTrackListBytes+1))
+	if err != nil {
+		return TrackList{}, err
+	}
+	if len(b) > maxTrackListBytes {
+		return TrackList{}, invalid("track list too large")
+	}
+	text := strings.TrimPrefix(string(b), "\ufeff")
+
+	var l TrackList
+	if isCue(text) {
+		l, err = parseCue(text)
+	} else {
+		l, err = parseChapters(text)
+	}
+	if err != nil {
+		return TrackList{}, err
+	}
+	if len(l.Tracks) == 0 {
+		return TrackList{}, invalid("track list has no tracks")
+	}
+	if len(l.Tracks) > MaxTracks {
+		return TrackList{}, invalid(fmt.Sprintf("at most %d tracks", MaxTracks))
+	}
+	for i := range l.Tracks {
+		if i > 0 && l.Tracks[i].Start <= l.Tracks[i-1].Start {
+			return TrackList{}, invalid(fmt.Sprintf("track %d does not start after track %d", i+1, i))
+		}
+		if i+1 < len(l.Tracks) {
+			l.Tracks[i].End = l.Tracks[i+1].Start
+		}
+	}
+	return l, nil
+}
+
+func isCue(text string) bool {
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		switch f := cueFields(scanner.Text()); {
+		case len(f) == 0:
+		case strings.EqualFold(f[0], "FILE"), strings.EqualFold(f[0], "TRACK"):
+			return true
+		}
+	}
+	return false
+}
+
+func parseCue(text string) (TrackList, error) {
+	var l TrackList
+	var cur *Track
+	files := 0
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for n := 1; scanner.Scan(); n++ {
+		f := cueFields(scanner.Text())
+		if len(f) < 2 {
+			continue
+		}
+		switch strings.ToUpper(f[0]) {
+		case "FILE":
+			if files++; files > 1 {
+				return l, invalid("cue sheets with several FILE entries are not supported")
+			}
+		case "TRACK":
+			if cur != nil && cur.Start < 0 {
+				return l, invalid(fmt.Sprintf("cue line %d: previous track has no INDEX 01", n))
+			}
+			l.Tracks = append(l.Tracks, Track{Start: -1})
+			cur = &l.Tracks[len(l.Tracks)-1]
+		case "TITLE":
+			if cur == nil {
+				l.Title = f[1]
+			} else {
+				cur.Title = f[1]
+			}
+		case "PERFORMER":
+			if cur == nil {
+				l.Performer = f[1]
+			} else {
+				cur.Performer = f[1]
+			}
+		case "INDEX":
+			if cur == nil || len(f) < 3 || f[1] != "01" {
+				continue
+			}
+			d, err := parseCueTime(f[2])
+			if err != nil {
+				return l, invalid(fmt.Sprintf("cue line %d: %v", n, err))
+			}
+			cur.Start = d
+		}
+	}
+	if cur != nil && cur.Start < 0 {
+		return l, invalid("last track has no INDEX 01")
+	}
+	return l, nil
+}
+
+// cueFields splits a CUE line into words, keeping quoted strings whole.
+func cueFields(line string) []string {
+	var fields []string
+	line = strings.TrimSpace(line)
+	for line != "" {
+		var f string
+		if line[0] == '"' {
+			end := strings.IndexByte(line[1:], '"')
+			if end < 0 {
+				f, line = line[1:], ""
+			} else {
+				f, line = line[1:end+1], line[end+2:]
+			}
+		} else {
+			end := strings.IndexFunc(line, unicode.IsSpace)
+			if end < 0 {
+				end = len(line)
+			}
+			f, line = line[:end], line[end:]
+		}
+		fields = append(fields, f)
+		line = strings.TrimLeftFunc(line, unicode.IsSpace)
+	}
+	return fields
+}
+
+// parseCueTime parses mm:ss:ff, where ff counts 1/75 s frames.
+func parseCueTime(s string) (time.Duration, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("invalid index time %q", s)
+	}
+	var v [3]int
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid index time %q", s)
+		}
+		v[i] = n
+	}
+	if v[1] >= 60 || v[2] >= cueFramesPerSec {
+		return 0, fmt.Errorf("invalid index time %q", s)
+	}
+	return time.Duration(v[0])*time.Minute + time.Duration(v[1])*time.Second +
+		time.Duration(v[2])*time.Second/cueFramesPerSec, nil
+}
+
+func parseChapters(text string) (TrackList, error) {
+	var l TrackList
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		stamp, title := line, ""
+		if i := strings.IndexFunc(line, unicode.IsSpace); i >= 0 {
+			stamp, title = line[:i], line[i:]
+		}
+		d, err := parseTimestamp(stamp)
+		if err != nil {
+			return l, invalid(fmt.Sprintf("chapter line %d: %v", n, err))
+		}
+		title = strings.TrimLeft(title, " \t-–|:")
+		l.Tracks = append(l.Tracks, Track{Title: strings.TrimSpace(title), Start: d})
+	}
+	return l, nil
+}
+
+// parseTimestamp parses [[hh:]mm:]ss[.fff].
+func parseTimestamp(s string) (time.Duration, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) > 3 {
+		return 0, fmt.Errorf("invalid timestamp %q", s)
+	}
+	var d time.Duration
+	for i, p := range parts {
+		last := i == len(parts)-1
+		var x float64
+		var err error
+		if last {
+			x, err = strconv.ParseFloat(p, 64)
+		} else {
+			var n int
+			n, err = strconv.Atoi(p)
+			x = float64(n)
+		}
+		if err != nil || x < 0 || (i > 0 && x >= 60) {
+			return 0, fmt.Errorf("invalid timestamp %q", s)
+		}
+		d = d*60 + time.Duration(x*float64(time.Second))
+	}
+	return d, nil
+}
+
+// Options returns the options for converting track i: its part of the
+// input, opts' fades and silence trimming, and the track's tags.
+func (l TrackList) Options(opts Options, i int) Options {
+	seg := l.Segment(i)
+	seg.FadeIn, seg.FadeOut = opts.Segment.FadeIn, opts.Segment.FadeOut
+	seg.TrimSilence = opts.Segment.TrimSilence
+	opts.Segment = seg
+
+	tags := maps.Clone(opts.Metadata)
+	if tags == nil {
+		tags = make(map[string]string)
+	}
+	maps.Copy(tags, l.Metadata(i))
+	opts.Metadata = tags
+	return opts
+}
+
+// ConvertTracks converts every track of list with one ffmpeg run each;
+// outputs[i] are the outputs of track i. opts.Segment may only hold fades
+// and silence trimming, which apply to each track. Progress covers all
+// tracks together.
+func ConvertTracks(ctx context.Context, input string, list TrackList, outputs [][]Output, opts Options) error {
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+	if opts.Segment.Start != 0 || opts.Segment.End != 0 {
+		return invalid("start and end cannot be combined with tracks")
+	}
+	if len(outputs) != len(list.Tracks) {
+		return invalid("outputs do not match tracks")
+	}
+	onProgress := opts.OnProgress
+	if onProgress != nil {
+		onProgress(Progress{Stage: StageProbing})
+	}
+	duration, err := Duration(input, opts)
+	if err != nil {
+		return err
+	}
+	if err := list.Check(duration); err != nil {
+		return err
+	}
+
+	var total time.Duration
+	for i := range list.Tracks {
+		total += list.Segment(i).Length(duration)
+	}
+	var done time.Duration
+	var doneSize int64
+	lastPct := 0
+	for i := range list.Tracks {
+		topts := list.Options(opts, i)
+		length := list.Segment(i).Length(duration)
+		if onProgress != nil {
+			last := i == len(list.Tracks)-1
+			topts.OnProgress = func(p Progress) {
+				if p.Stage == StageProbing {
+					return
+				}
+				// Silence trimming and rounding can move a track's
+				// reported time off its length; keep it within its share.
+				p.Processed = done + min(p.Processed, length)
+				p.Total = total
+				p.Percent, p.ETA = estimate(p.Processed, total, p.Speed)
+				p.Percent = max(p.Percent, lastPct)
+				lastPct = p.Percent
+				p.OutputSize += doneSize
+				if p.Done {
+					if !last {
+						p.Done = false
+					} else {
+						p.Percent = 100
+					}
+				}
+				onProgress(p)
+			}
+		}
+		if err := ConvertOutputs(ctx, input, outputs[i], topts); err != nil {
+			return err
+		}
+		done += length
+		for _, o := range outputs[i] {
+			if fi, err := os.Stat(o.Path); err == nil {
+				doneSize += fi.Size()
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,282 @@
+package pipeline
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"os"
+	"slices"
+	"time"
+)
+
+const (
+	wavePCM        = 1
+	waveFloat      = 3
+	waveExtensible = 0xfffe
+)
+
+// wavFormat describes the samples of a WAV stream.
+type wavFormat struct {
+	tag      uint16
+	channels int
+	rate     int
+	bits     int
+}
+
+func (f wavFormat) frameSize() int { return f.channels * f.bits / 8 }
+
+func (f wavFormat) supported() bool {
+	switch f.tag {
+	case wavePCM:
+		return f.bits == 8 || f.bits == 16 || f.bits == 24 || f.bits == 32
+	case waveFloat:
+		return f.bits == 32 || f.bits == 64
+	}
+	return false
+}
+
+// sample decodes one sample, scaled to [-1, 1] for integer formats.
+func (f wavFormat) sample(b []byte) float32 {
+	switch {
+	case f.tag == waveFloat && f.bits == 32:
+		return math.Float32frombits(binary.LittleEndian.Uint32(b))
+	case f.tag == waveFloat:
+		return float32(math.Float64frombits(binary.LittleEndian.Uint64(b)))
+	case f.bits == 8:
+		return (float32(b[0]) - 128) / 128
+	case f.bits == 16:
+		return float32(int16(binary.LittleEndian.Uint16(b))) / (1 << 15)
+	case f.bits == 24:
+		return float32(int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24)>>8) / (1 << 23)
+	default:
+		return float32(int32(binary.LittleEndian.Uint32(b))) / (1 << 31)
+	}
+}
+
+// readWAVHeader reads a RIFF WAVE header up to the start of the sample
+// data. size is the length of the data, or -1 when the header leaves it
+// open, as ffmpeg does when writing to a pipe.
+func readWAVHeader(r io.Reader) (f wavFormat, size int64, err error) {
+	var riff [12]byte
+	if _, err := io.ReadFull(r, riff[:]); err != nil {
+		return f, 0, err
+	}
+	if string(riff[:4]) != "RIFF" || string(riff[8:]) != "WAVE" {
+		return f, 0, errors.New("not a WAV stream")
+	}
+	for {
+		var h [8]byte
+		if _, err := io.ReadFull(r, h[:]); err != nil {
+			return f, 0, err
+		}
+		size := int64(binary.LittleEndian.Uint32(h[4:]))
+		switch string(h[:4]) {
+		case "fmt ":
+			if size < 16 {
+				return f, 0, errors.New("short WAV fmt chunk")
+			}
+			// Only the first 40 bytes are read; the rest of a chunk that
+			// claims to be longer is skipped rather than held in memory.
+			b := make([]byte, min(size, 40))
+			if _, err := io.ReadFull(r, b); err != nil {
+				return f, 0, err
+			}
+			if _, err := io.CopyN(io.Discard, r, size+size&1-int64(len(b))); err != nil {
+				return f, 0, err
+			}
+			f = wavFormat{
+				tag:      binary.LittleEndian.Uint16(b),
+				channels: int(binary.LittleEndian.Uint16(b[2:])),
+				rate:     int(binary.LittleEndian.Uint32(b[4:])),
+				bits:     int(binary.LittleEndian.Uint16(b[14:])),
+			}
+			if f.tag == waveExtensible && size >= 40 {
+				// The sub-format GUID starts with the actual format tag.
+				f.tag = binary.LittleEndian.Uint16(b[24:])
+			}
+		case "data":
+			if f.channels <= 0 || f.rate <= 0 || f.bits <= 0 {
+				return f, 0, errors.New("WAV data before a valid fmt chunk")
+			}
+			if size == 0 || size == math.MaxUint32 {
+				size = -1
+			}
+			return f, size, nil
+		default:
+			if _, err := io.CopyN(io.Discard, r, size+size&1); err != nil {
+				return f, 0, err
+			}
+		}
+	}
+}
+
+// pcmAudio is decoded audio with one slice of samples per channel.
+type pcmAudio struct {
+	rate int
+	ch   [][]float32
+}
+
+func (a *pcmAudio) frames() int {
+	if len(a.ch) == 0 {
+		return 0
+	}
+	return len(a.ch[0])
+}
+
+func (a *pcmAudio) duration() time.Duration {
+	return time.Duration(a.frames()) * time.Second / time.Duration(a.rate)
+}
+
+// readWAV decodes a WAV stream in any format wavFormat supports. Streams
+// longer than limit fail with ErrTooLong, however long the header says they
+// are.
+func readWAV(r io.Reader, limit time.Duration) (*pcmAudio, error) {
+	br := bufio.NewReaderSize(r, 64<<10)
+	f, size, err := readWAVHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	if !f.supported() {
+		return nil, fmt.Errorf("unsupported WAV format %d with %d bits", f.tag, f.bits)
+	}
+	var src io.Reader = br
+	if size >= 0 {
+		src = io.LimitReader(br, size)
+	}
+	a := &pcmAudio{rate: f.rate, ch: make([][]float32, f.channels)}
+	maxFrames := int(limit.Seconds() * float64(f.rate))
+	fs, bps := f.frameSize(), f.bits/8
+	buf := make([]byte, fs*4096)
+	for {
+		n, err := io.ReadFull(src, buf)
+		if a.frames()+n/fs > maxFrames {
+			return nil, fmt.Errorf("%w: longer than %s", ErrTooLong, limit)
+		}
+		for off := 0; off+fs <= n; off += fs {
+			for c := range a.ch {
+				a.ch[c] = append(a.ch[c], f.sample(buf[off+c*bps:]))
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return a, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// wavInfo maps tag names to the RIFF INFO chunks ffmpeg writes them as.
+var wavInfo = map[string]string{
+	"album":   "IPRD",
+	"artist":  "IART",
+	"comment": "ICMT",
+	"date":    "ICRD",
+	"genre":   "IGNR",
+	"title":   "INAM",
+	"track":   "IPRT",
+}
+
+// writeWAV encodes a as 16-bit PCM, with the tags WAV can hold in a LIST
+// INFO chunk.
+func writeWAV(w io.Writer, a *pcmAudio, tags map[string]string) error {
+	var info []byte
+	for _, k := range slices.Sorted(maps.Keys(tags)) {
+		id, ok := wavInfo[k]
+		if !ok {
+			continue
+		}
+		v := append([]byte(tags[k]), 0)
+		info = append(info, id...)
+		info = binary.LittleEndian.AppendUint32(info, uint32(len(v)))
+		info = append(info, v...)
+		if len(v)%2 == 1 {
+			info = append(info, 0)
+		}
+	}
+	channels := len(a.ch)
+	data := int64(a.frames()) * int64(channels) * 2
+	riff := 4 + 8 + 16 + 8 + data
+	if len(info) > 0 {
+		riff += 8 + 4 + int64(len(info))
+	}
+	if riff > math.MaxUint32 {
+		return errors.New("output too large for WAV")
+	}
+
+	bw := bufio.NewWriterSize(w, 64<<10)
+	h := []byte("RIFF")
+	h = binary.LittleEndian.AppendUint32(h, uint32(riff))
+	h = append(h, "WAVEfmt "...)
+	h = binary.LittleEndian.AppendUint32(h, 16)
+	h = binary.LittleEndian.AppendUint16(h, wavePCM)
+	h = binary.LittleEndian.AppendUint16(h, uint16(channels))
+	h = binary.LittleEndian.AppendUint32(h, uint32(a.rate))
+	h = binary.LittleEndian.AppendUint32(h, uint32(a.rate*channels*2))
+	h = binary.LittleEndian.AppendUint16(h, uint16(channels*2))
+	h = binary.LittleEndian.AppendUint16(h, 16)
+	if len(info) > 0 {
+		h = append(h, "LIST"...)
+		h = binary.LittleEndian.AppendUint32(h, uint32(4+len(info)))
+		h = append(h, "INFO"...)
+		h = append(h, info...)
+	}
+	h = append(h, "data"...)
+	h = binary.LittleEndian.AppendUint32(h, uint32(data))
+	if _, err := bw.Write(h); err != nil {
+		return err
+	}
+	var s [2]byte
+	for i := range a.frames() {
+		for c := range channels {
+			v := math.Round(float64(a.ch[c][i]) * (1 << 15))
+			binary.LittleEndian.PutUint16(s[:], uint16(int16(min(max(v, math.MinInt16), math.MaxInt16))))
+			if _, err := bw.Write(s[:]); err != nil {
+				return err
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// wavFileFormat reads the header of the WAV file at path and returns its
+// format and the duration of its samples.
+func wavFileFormat(path string) (wavFormat, time.Duration, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return wavFormat{}, 0, err
+	}
+	defer fh.Close()
+	cr := &countingReader{r: bufio.NewReader(fh)}
+	f, size, err := readWAVHeader(cr)
+	if err != nil {
+		return f, 0, err
+	}
+	if size < 0 {
+		fi, err := fh.Stat()
+		if err != nil {
+			return f, 0, err
+		}
+		size = fi.Size() - cr.n
+	}
+	if f.frameSize() == 0 {
+		return f, 0, errors.New("invalid WAV frame size")
+	}
+	frames := size / int64(f.frameSize())
+	return f, time.Duration(frames) * time.Second / time.Duration(f.rate), nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}